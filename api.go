@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/naming"
+)
+
+// maxRequestSize bounds the body of the control API requests
+const maxRequestSize = 64 * 1024
+
+// authorized only lets the requests with the bearer token set by http.api-token through to h
+func (s *snapshotter) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := s.currentConfig().HTTP.APIToken
+		if token == "" {
+			writeAPIError(w, http.StatusForbidden, errors.New("the control API is disabled: set http.api-token to enable it"))
+			return
+		}
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// backupRequest is the body of POST /v1/backups, which may be empty
+type backupRequest struct {
+	// Outputs are the names of the outputs to export the snapshot to, or all of them if empty
+	Outputs []string `json:"outputs"`
+	// Force uploads the snapshot even to the outputs that hold the same cluster state already
+	Force bool `json:"force"`
+}
+
+func (s *snapshotter) createBackup(w http.ResponseWriter, r *http.Request) {
+	var req backupRequest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil && err != io.EOF {
+		writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+	if _, err := selectOutputs(s.currentConfig().Outputs, req.Outputs); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	run := newBackupRun(triggerAPI, req.Outputs, req.Force)
+	if err := s.startRun(run); err != nil {
+		writeAPIError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	logger.With("run_id", run.ID).Info("Backup requested through the API by ", r.RemoteAddr)
+
+	w.Header().Set("Location", "/v1/backups/"+run.ID)
+	writeJSON(w, http.StatusAccepted, run.view())
+}
+
+func (s *snapshotter) listBackups(w http.ResponseWriter, r *http.Request) {
+	views := []backupRunView{}
+	for _, run := range s.runs.list() {
+		views = append(views, run.view())
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (s *snapshotter) getBackup(w http.ResponseWriter, r *http.Request) {
+	run := s.runs.get(r.PathValue("id"))
+	if run == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("unknown backup %q", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, http.StatusOK, run.view())
+}
+
+func (s *snapshotter) cancelBackup(w http.ResponseWriter, r *http.Request) {
+	run := s.runs.get(r.PathValue("id"))
+	if run == nil {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("unknown backup %q", r.PathValue("id")))
+		return
+	}
+	if !run.requestCancel() {
+		writeAPIError(w, http.StatusConflict, fmt.Errorf("backup %s has finished already", run.ID))
+		return
+	}
+	logger.With("run_id", run.ID).Info("Backup cancelled through the API by ", r.RemoteAddr)
+	writeJSON(w, http.StatusAccepted, run.view())
+}
+
+// outputSnapshots lists the snapshots of an output, or the error that prevented it
+type outputSnapshots struct {
+	Snapshots []snapshotInfo `json:"snapshots"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// listSnapshots lists the snapshots of every output, or only of the one given by the "output" query parameter
+func (s *snapshotter) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	c := s.currentConfig()
+	tmpl, err := naming.New(c.FilenameTemplate)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var names []string
+	if name := r.URL.Query().Get("output"); name != "" {
+		names = []string{name}
+	}
+	outs, err := selectOutputs(c.Outputs, names)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err)
+		return
+	}
+
+	result := map[string]outputSnapshots{}
+	for _, oc := range outs {
+		snapshots, err := listSnapshots(r.Context(), c, tmpl, oc, "")
+		if err != nil {
+			result[oc.Name] = outputSnapshots{Snapshots: []snapshotInfo{}, Error: err.Error()}
+			continue
+		}
+		result[oc.Name] = outputSnapshots{Snapshots: snapshots}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path"
-	"time"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 
@@ -29,6 +31,9 @@ type AzureConfig struct {
 	Parallelism      uint16
 	Emulated         bool
 	EmulatorUrl      string
+	// MaxRetries is the number of times the client retries a failed request on its own
+	// (0 - the SDK default, negative - none, e.g. when the caller retries the whole operation)
+	MaxRetries int32
 }
 
 type Azure struct {
@@ -36,7 +41,7 @@ type Azure struct {
 	config *AzureConfig
 }
 
-func NewAzure(config *AzureConfig) (*Azure, error) {
+func NewAzure(ctx context.Context, config *AzureConfig) (*Azure, error) {
 	var (
 		azclient *azblob.Client
 		azURL    *url.URL
@@ -50,6 +55,10 @@ func NewAzure(config *AzureConfig) (*Azure, error) {
 		return nil, fmt.Errorf("Azure Account Access Key or SAS Token must be provided")
 	}
 
+	options := &azblob.ClientOptions{ClientOptions: azcore.ClientOptions{
+		Retry: policy.RetryOptions{MaxRetries: config.MaxRetries},
+	}}
+
 	// create azure client
 	if config.StorageSASToken != "" {
 		if config.Emulated {
@@ -57,8 +66,8 @@ func NewAzure(config *AzureConfig) (*Azure, error) {
 		} else {
 			azURL, _ = url.Parse(fmt.Sprintf("https://%s.%s/?%s", config.StorageAccount, config.CloudDomain, config.StorageSASToken))
 		}
-		logger.Debug("Using Azure Blob URL: ", azURL.String())
-		azclient, err = azblob.NewClientWithNoCredential(azURL.String(), nil)
+		logger.FromContext(ctx).Debug("Using Azure Blob URL: ", redactURL(azURL))
+		azclient, err = azblob.NewClientWithNoCredential(azURL.String(), options)
 	} else {
 		if config.Emulated {
 			azURL, _ = url.Parse(fmt.Sprintf("%s/%s/", config.EmulatorUrl, config.StorageAccount))
@@ -69,8 +78,8 @@ func NewAzure(config *AzureConfig) (*Azure, error) {
 		if cerr != nil {
 			return nil, cerr
 		}
-		logger.Debug("Using Azure Blob URL: ", azURL.String())
-		azclient, err = azblob.NewClientWithSharedKeyCredential(azURL.String(), cred, nil)
+		logger.FromContext(ctx).Debug("Using Azure Blob URL: ", redactURL(azURL))
+		azclient, err = azblob.NewClientWithSharedKeyCredential(azURL.String(), cred, options)
 	}
 
 	if err != nil {
@@ -80,78 +89,167 @@ func NewAzure(config *AzureConfig) (*Azure, error) {
 	return &Azure{client: azclient, config: config}, nil
 }
 
-func (az *Azure) ListBlobsOlderThan(period time.Duration) ([]*container.BlobItem, error) {
+// BlobPrefix returns the prefix of the blob names inside ContainerPath
+func (az *Azure) BlobPrefix() string {
+	p := strings.Trim(path.Clean("/"+az.config.ContainerPath), "/")
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+// ListBlobs lists the blobs inside ContainerPath, at any depth
+func (az *Azure) ListBlobs(ctx context.Context) ([]*container.BlobItem, error) {
 	var results = make([]*container.BlobItem, 0)
 
 	// blob listings are returned across multiple pages
-	pager := az.client.NewListBlobsFlatPager(az.config.ContainerName, nil)
+	prefix := az.BlobPrefix()
+	pager := az.client.NewListBlobsFlatPager(az.config.ContainerName, &container.ListBlobsFlatOptions{Prefix: &prefix})
 
 	// continue fetching pages until no more remain
 	for pager.More() {
 		// advance to the next page
-		logger.Debug("Getting next page of blobs...")
-		page, err := pager.NextPage(context.Background())
+		logger.FromContext(ctx).Debug("Getting next page of blobs...")
+		page, err := pager.NextPage(ctx)
 		if err != nil {
-			return nil, err
+			return nil, redactError(err)
 		}
 
-		for _, blob := range page.Segment.BlobItems {
-			if time.Since(*blob.Properties.LastModified) > period {
-				results = append(results, blob)
-			}
-		}
+		results = append(results, page.Segment.BlobItems...)
 	}
 
 	return results, nil
 }
 
-func (az *Azure) DeleteBlob(blob *container.BlobItem) error {
-	logger.Debug("Deleting blob: ", *blob.Name)
-	_, err := az.client.DeleteBlob(context.Background(), az.config.ContainerName, *blob.Name, nil)
+func (az *Azure) DeleteBlob(ctx context.Context, name string) error {
+	logger.FromContext(ctx).Debug("Deleting blob: ", name)
+	_, err := az.client.DeleteBlob(ctx, az.config.ContainerName, name, nil)
 	if err != nil {
-		return err
+		return redactError(err)
 	}
 
 	return nil
 }
 
-func (az *Azure) UploadBlob(srcFile string) error {
-	// Create the container if it doesn't exist
-	if az.config.CreateContainer {
-		logger.Debug("Creating container: ", az.config.ContainerName)
-		// _, err := azclient.CreateContainer(context.Background(), az.ContainerName, &azblob.CreateContainerOptions{
-		// 	Access: azblob.PublicAccessNone,
-		// })
-		_, err := az.client.CreateContainer(context.Background(), az.config.ContainerName, nil)
-		az.client.URL()
-
-		var respErr *azcore.ResponseError
-		if err != nil {
-			if !(errors.As(err, &respErr) && respErr.ErrorCode == "ContainerAlreadyExists") {
-				return fmt.Errorf("error creating container: %s", err)
-			} else {
-				logger.Debug("Got ContainerAlreadyExists, ignoring...")
-			}
-		}
+// DownloadBlob streams the blob name, which the caller must close
+func (az *Azure) DownloadBlob(ctx context.Context, name string) (io.ReadCloser, error) {
+	logger.FromContext(ctx).Debug("Downloading blob: ", name)
+	resp, err := az.client.DownloadStream(ctx, az.config.ContainerName, name, nil)
+	if err != nil {
+		return nil, redactError(err)
+	}
+	return resp.Body, nil
+}
+
+// UploadBlob uploads srcFile to the container, and returns its size
+func (az *Azure) UploadBlob(ctx context.Context, srcFile string) (int64, error) {
+	if err := az.createContainer(ctx); err != nil {
+		return 0, err
 	}
 
 	// Upload the blob
-	logger.Info(fmt.Sprintf("Uploading the file (BlockSize: %v, Parallelism: %v)", az.config.BlockSize, az.config.Parallelism))
+	logger.FromContext(ctx).Info(fmt.Sprintf("Uploading the file (BlockSize: %v, Parallelism: %v)", az.config.BlockSize, az.config.Parallelism))
 
 	file, err := os.Open(srcFile)
 	if err != nil {
-		return fmt.Errorf("error opening file: %s", err)
+		return 0, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error reading file info: %s", err)
 	}
 
-	destFile := path.Join(az.config.ContainerPath, az.config.Filename)
+	destFile := az.BlobPrefix() + az.config.Filename
 
-	_, err = az.client.UploadFile(context.Background(), az.config.ContainerName, destFile, file, &azblob.UploadFileOptions{
+	_, err = az.client.UploadFile(ctx, az.config.ContainerName, destFile, file, &azblob.UploadFileOptions{
 		BlockSize:   az.config.BlockSize,
 		Concurrency: az.config.Parallelism,
 	})
 	if err != nil {
-		return fmt.Errorf("error uploading file: %s", err)
+		return 0, fmt.Errorf("error uploading file: %w", redactError(err))
+	}
+
+	return info.Size(), nil
+}
+
+// UploadBlobStream uploads what is read from r to the container, and returns its size.
+// Unlike UploadBlob, the blocks are read from r one after the other, so that r can pace the upload.
+func (az *Azure) UploadBlobStream(ctx context.Context, r io.Reader) (int64, error) {
+	if err := az.createContainer(ctx); err != nil {
+		return 0, err
 	}
 
+	// Upload the blob
+	logger.FromContext(ctx).Info(fmt.Sprintf("Uploading the stream (BlockSize: %v, Parallelism: %v)", az.config.BlockSize, az.config.Parallelism))
+
+	destFile := az.BlobPrefix() + az.config.Filename
+	cr := &countingReader{r: r}
+
+	_, err := az.client.UploadStream(ctx, az.config.ContainerName, destFile, cr, &azblob.UploadStreamOptions{
+		BlockSize:   az.config.BlockSize,
+		Concurrency: int(az.config.Parallelism),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error uploading stream: %w", redactError(err))
+	}
+
+	return cr.n, nil
+}
+
+// createContainer creates the container, if CreateContainer is set and it doesn't exist
+func (az *Azure) createContainer(ctx context.Context) error {
+	if !az.config.CreateContainer {
+		return nil
+	}
+
+	logger.FromContext(ctx).Debug("Creating container: ", az.config.ContainerName)
+	_, err := az.client.CreateContainer(ctx, az.config.ContainerName, nil)
+
+	var respErr *azcore.ResponseError
+	if err != nil {
+		if !(errors.As(err, &respErr) && respErr.ErrorCode == "ContainerAlreadyExists") {
+			return fmt.Errorf("error creating container: %w", redactError(err))
+		} else {
+			logger.FromContext(ctx).Debug("Got ContainerAlreadyExists, ignoring...")
+		}
+	}
 	return nil
 }
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// redactURL returns u as a string without its query, which may hold a SAS token
+func redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+	redacted := *u
+	redacted.RawQuery = "REDACTED"
+	return redacted.String()
+}
+
+// redactError removes the query from the URL of transport errors, which would otherwise leak the SAS token.
+// Errors returned by the service (azcore.ResponseError) already leave the query out.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, perr := url.Parse(urlErr.URL); perr == nil {
+			urlErr.URL = redactURL(u)
+		} else {
+			urlErr.URL = "REDACTED"
+		}
+	}
+	return err
+}
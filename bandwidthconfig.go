@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+
+	"github.com/ruizink/consul-snapshotter/throttle"
+)
+
+// bandwidthConfig limits the bytes per second written by the outputs, whether to the network or to the disk
+type bandwidthConfig struct {
+	// Limit is the limit in bytes per second outside of the windows of the schedule (0 - no limit)
+	Limit int64 `json:"limit"`
+	// Schedule overrides the limit at some times of the day
+	Schedule []bandwidthWindow `json:"schedule"`
+
+	// settings of the limit that could not be read
+	invalidSettings []error
+}
+
+// bandwidthWindow sets the limit between two times of the day, in local time
+type bandwidthWindow struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Limit int64  `json:"limit"`
+
+	// settings of the window that it does not have
+	unknownKeys []string
+}
+
+// readBandwidthConfig reads the limit under prefix, as bytes per second or sizes with a unit,
+// and the windows of its schedule:
+//
+//	bandwidth:
+//	  limit: 50MiB
+//	  schedule:
+//	    - from: "08:00"
+//	      to: "20:00"
+//	      limit: 5MiB
+func readBandwidthConfig(v *viper.Viper, prefix string) bandwidthConfig {
+	bc := bandwidthConfig{}
+	var err error
+	if bc.Limit, err = readRate(v.Get(prefix + "limit")); err != nil {
+		bc.invalidSettings = append(bc.invalidSettings, fmt.Errorf("limit: %v", err))
+	}
+
+	var entries []interface{}
+	switch schedule := v.Get(prefix + "schedule").(type) {
+	case []interface{}:
+		entries = schedule
+	case nil:
+	default:
+		bc.invalidSettings = append(bc.invalidSettings, fmt.Errorf("schedule: expected a list, got %T", schedule))
+	}
+	for i, entry := range entries {
+		settings, ok := entry.(map[string]interface{})
+		if !ok {
+			bc.invalidSettings = append(bc.invalidSettings, fmt.Errorf("schedule.%d: expected a window with from, to and limit, got %T", i, entry))
+			continue
+		}
+		w := bandwidthWindow{From: cast.ToString(settings["from"]), To: cast.ToString(settings["to"])}
+		if w.Limit, err = readRate(settings["limit"]); err != nil {
+			bc.invalidSettings = append(bc.invalidSettings, fmt.Errorf("schedule.%d.limit: %v", i, err))
+		}
+		for key := range settings {
+			if !hasJSONField(reflect.TypeOf(w), key) {
+				w.unknownKeys = append(w.unknownKeys, key)
+			}
+		}
+		sort.Strings(w.unknownKeys)
+		bc.Schedule = append(bc.Schedule, w)
+	}
+	return bc
+}
+
+// readRate reads a rate in bytes per second, as a number or a string with a unit (e.g. "10MiB")
+func readRate(value interface{}) (int64, error) {
+	switch value := value.(type) {
+	case nil:
+		return 0, nil
+	case string:
+		if value == "" {
+			return 0, nil
+		}
+		return throttle.ParseRate(value)
+	default:
+		n, err := cast.ToInt64E(value)
+		if err != nil {
+			return 0, fmt.Errorf("expected bytes per second, got %q", fmt.Sprint(value))
+		}
+		return n, nil
+	}
+}
+
+// validate lists the problems of the limit, set at prefix, through problem
+func (bc *bandwidthConfig) validate(prefix string, problem func(format string, a ...interface{})) {
+	for _, err := range bc.invalidSettings {
+		problem("%s.%v", prefix, err)
+	}
+	if bc.Limit < 0 {
+		problem("%s.limit: must not be negative", prefix)
+	}
+	for i, w := range bc.Schedule {
+		key := fmt.Sprintf("%s.schedule.%d", prefix, i)
+		for _, k := range w.unknownKeys {
+			problem("%s: unknown setting %q", key, k)
+		}
+		from, fromErr := throttle.ParseTimeOfDay(w.From)
+		if fromErr != nil {
+			problem("%s.from: %v", key, fromErr)
+		}
+		to, toErr := throttle.ParseTimeOfDay(w.To)
+		if toErr != nil {
+			problem("%s.to: %v", key, toErr)
+		}
+		if fromErr == nil && toErr == nil && from == to {
+			problem("%s: from and to must differ", key)
+		}
+		if w.Limit < 0 {
+			problem("%s.limit: must not be negative", key)
+		}
+	}
+}
+
+// limiter returns the limiter of bc, or nil if it never limits
+func (bc *bandwidthConfig) limiter() *throttle.Limiter {
+	s := throttle.Schedule{Rate: bc.Limit}
+	for _, w := range bc.Schedule {
+		// the windows were validated already
+		from, _ := throttle.ParseTimeOfDay(w.From)
+		to, _ := throttle.ParseTimeOfDay(w.To)
+		s.Windows = append(s.Windows, throttle.Window{From: from, To: to, Rate: w.Limit})
+	}
+	return throttle.NewLimiter(s)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/naming"
+	"github.com/ruizink/consul-snapshotter/outputs"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(stdout io.Writer) int
+}
+
+// commands lists the subcommands, which run instead of the snapshotter
+var commands = []command{
+	{name: "config validate", usage: "Validates the config and lists every problem found", run: configValidate},
+	{name: "config show", usage: "Prints the effective config, with secrets redacted, and where each setting came from", run: configShow},
+	{name: "snapshots list", usage: "Lists the snapshots saved to each output", run: snapshotsList},
+	{name: "verify-restore", usage: "Restores the latest snapshot into a scratch Consul, and runs the sanity checks against it", run: verifyRestore},
+}
+
+// runCommand runs the subcommand given in args, returning the process exit code
+func runCommand(args []string) int {
+	name := strings.Join(args, " ")
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(os.Stdout)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command: %s (see --help)\n", name)
+	return exitError
+}
+
+func configValidate(stdout io.Writer) int {
+	c, err := loadConfig()
+	if err != nil {
+		printConfigProblems(stdout, err)
+		return exitInvalidConfig
+	}
+
+	if c.configFile != "" {
+		fmt.Fprintln(stdout, "Config file:", c.configFile)
+	} else {
+		fmt.Fprintln(stdout, "Config file: none found in", c.ConfigDir)
+	}
+
+	if err := c.validate(); err != nil {
+		printConfigProblems(stdout, err)
+		return exitInvalidConfig
+	}
+
+	fmt.Fprintln(stdout, "Config is valid.")
+	return exitOK
+}
+
+func configShow(stdout io.Writer) int {
+	c, err := loadConfig()
+	if err != nil {
+		printConfigProblems(stdout, err)
+		return exitInvalidConfig
+	}
+
+	if c.configFile != "" {
+		fmt.Fprintln(stdout, "# Config file:", c.configFile)
+	} else {
+		fmt.Fprintln(stdout, "# Config file: none found in", c.ConfigDir)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	for _, f := range configFields(c) {
+		fmt.Fprintf(w, "%s\t= %q\t# %s\n", f.Key, f.DisplayValue(), c.sources[f.Key])
+	}
+	w.Flush()
+
+	if err := c.validate(); err != nil {
+		fmt.Fprintln(stdout, "# The config is invalid, see: config validate")
+		return exitInvalidConfig
+	}
+	return exitOK
+}
+
+func snapshotsList(stdout io.Writer) int {
+	c, err := loadConfig()
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		printConfigProblems(stdout, err)
+		return exitInvalidConfig
+	}
+
+	tmpl, err := naming.New(c.FilenameTemplate)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid filename template:", err)
+		return exitInvalidConfig
+	}
+
+	code := exitOK
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OUTPUT\tSNAPSHOT\tSIZE\tMODIFIED\tLAST INDEX\tTIME")
+	for _, oc := range c.Outputs {
+		snapshots, err := listSnapshots(context.Background(), c, tmpl, oc, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not list the snapshots of output %s: %v\n", oc.Name, err)
+			code = exitError
+			continue
+		}
+
+		for _, s := range snapshots {
+			index, snapTime := "-", "-"
+			if s.LastIndex > 0 {
+				index = fmt.Sprint(s.LastIndex)
+			}
+			if s.Time != nil {
+				snapTime = s.Time.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", oc.Name, s.Name, s.Size, s.ModTime.Format(time.RFC3339), index, snapTime)
+		}
+	}
+	w.Flush()
+	return code
+}
+
+func verifyRestore(stdout io.Writer) int {
+	c, err := loadConfig()
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		printConfigProblems(stdout, err)
+		return exitInvalidConfig
+	}
+	logger.SetLevel(c.LogLevel)
+	logger.SetFormat(c.LogFormat)
+
+	// stop the dev agent on SIGTERM/SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := newSnapshotter(c).verifyRestore(ctx, triggerSingle); err != nil {
+		fmt.Fprintln(stdout, "Restore verification failed:", strings.TrimSpace(err.Error()))
+		return exitCode(err)
+	}
+	fmt.Fprintln(stdout, "Restore verified.")
+	return exitOK
+}
+
+// snapshotInfo describes a snapshot saved to an output, with the fields parsed back from its name
+type snapshotInfo struct {
+	Name      string     `json:"name"`
+	Size      int64      `json:"size"`
+	ModTime   time.Time  `json:"modified"`
+	LastIndex uint64     `json:"last-index,omitempty"`
+	Time      *time.Time `json:"time,omitempty"`
+}
+
+// takenAt returns the time the snapshot was taken, from its name, or else the time it was last modified
+func (s snapshotInfo) takenAt() time.Time {
+	if s.Time != nil {
+		return *s.Time
+	}
+	return s.ModTime
+}
+
+// listSnapshots lists the snapshots of the cluster datacenter (any, if empty) saved to the output oc,
+// named after tmpl or an earlier template
+func listSnapshots(ctx context.Context, c *config, tmpl *naming.Template, oc outputConfig, datacenter string) ([]snapshotInfo, error) {
+	ctx, cancel := withTimeout(ctx, c.Timeouts.Retention)
+	defer cancel()
+	snapshots, err := newOutput(oc, "", snapshotMatcher(c, tmpl, oc, datacenter)).List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := snapshotPatterns(c, tmpl, oc, datacenter)
+	infos := make([]snapshotInfo, 0, len(snapshots))
+	for _, s := range snapshots {
+		var data naming.Data
+		names := []string{s.Name}
+		if name, ok := outputs.TrimDatePartition(s.Name); ok {
+			names = append(names, name)
+		}
+	parse:
+		for _, name := range names {
+			for _, p := range patterns {
+				if d, ok := p.Parse(name); ok {
+					data = d
+					break parse
+				}
+			}
+		}
+
+		info := snapshotInfo{Name: s.Name, Size: s.Size, ModTime: s.ModTime.UTC(), LastIndex: data.LastIndex}
+		if !data.Time.IsZero() {
+			t := data.Time.UTC()
+			info.Time = &t
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func printConfigProblems(stdout io.Writer, err error) {
+	problems := configProblems(err)
+	fmt.Fprintf(stdout, "Found %d problem(s):\n", len(problems))
+	for _, problem := range problems {
+		fmt.Fprintln(stdout, "  -", problem)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"time"
@@ -10,46 +11,154 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/naming"
+	"github.com/ruizink/consul-snapshotter/outputs"
+	"github.com/ruizink/consul-snapshotter/retry"
 	"github.com/ruizink/consul-snapshotter/version"
 )
 
 type consulConfig struct {
 	URL         string        `json:"url"`
-	Token       string        `json:"token"`
+	Token       string        `json:"token" secret:"true"`
+	TokenFile   string        `json:"token-file"`
 	LockKey     string        `json:"lock-key"`
 	LockTimeout time.Duration `json:"lock-timeout"`
+	StateKey    string        `json:"state-key"`
+}
+
+type skipUnchangedConfig struct {
+	Enabled     bool          `json:"enabled"`
+	MaxInterval time.Duration `json:"max-interval"`
+}
+
+// sanityChecksConfig asserts what a snapshot of the cluster holds, 0 or empty disabling each check
+type sanityChecksConfig struct {
+	MinKVEntries       int      `json:"min-kv-entries"`
+	MinNodes           int      `json:"min-nodes"`
+	MinServices        int      `json:"min-services"`
+	RequiredKVPrefixes []string `json:"required-kv-prefixes"`
+	// MaxShrink is the share of its size the snapshot may lose since the last one that passed the checks, from 0 to 1
+	MaxShrink float64 `json:"max-shrink"`
+}
+
+// verifyRestoreConfig restores the latest snapshot of an output into a scratch Consul, to prove it can be restored
+type verifyRestoreConfig struct {
+	// Schedule is the cron expression of the verifications run by the scheduler, if any
+	Schedule string `json:"schedule"`
+	// Output is the name of the output to restore the latest snapshot of, or empty for the first one
+	Output string `json:"output"`
+	// ConsulBinary is run as a dev agent to restore into, unless URL is set
+	ConsulBinary string `json:"consul-binary"`
+	// URL is the address of a scratch cluster to restore into, whose state is replaced
+	URL       string        `json:"url"`
+	Token     string        `json:"token" secret:"true"`
+	TokenFile string        `json:"token-file"`
+	Timeout   time.Duration `json:"timeout"`
 }
 
 type localOutputConfig struct {
 	DestinationPath   string        `json:"destination-path"`
 	RetentionPeriod   time.Duration `json:"retention-period"`
 	CreateDestination bool          `json:"create-destination"`
+	Layout            string        `json:"layout"`
 }
 
 type azureOutputConfig struct {
-	ContainerName    string        `json:"container-name"`
-	ContainerPath    string        `json:"container-path"`
-	StorageAccount   string        `json:"storage-account"`
-	CloudDomain      string        `json:"cloud-domain"`
-	StorageAccessKey string        `json:"storage-access-key"`
-	StorageSASToken  string        `json:"storage-sas-token"`
-	CreateContainer  bool          `json:"create-container"`
-	BlockSize        int64         `json:"block-size"`
-	Parallelism      uint16        `json:"parallelism"`
-	RetentionPeriod  time.Duration `json:"retention-period"`
-	Emulated         bool          `json:"emulated"`
-	EmulatorUrl      string        `json:"emulator-url"`
+	ContainerName        string        `json:"container-name"`
+	ContainerPath        string        `json:"container-path"`
+	StorageAccount       string        `json:"storage-account"`
+	CloudDomain          string        `json:"cloud-domain"`
+	StorageAccessKey     string        `json:"storage-access-key" secret:"true"`
+	StorageAccessKeyFile string        `json:"storage-access-key-file"`
+	StorageSASToken      string        `json:"storage-sas-token" secret:"true"`
+	StorageSASTokenFile  string        `json:"storage-sas-token-file"`
+	CreateContainer      bool          `json:"create-container"`
+	BlockSize            int64         `json:"block-size"`
+	Parallelism          uint16        `json:"parallelism"`
+	RetentionPeriod      time.Duration `json:"retention-period"`
+	Emulated             bool          `json:"emulated"`
+	EmulatorUrl          string        `json:"emulator-url"`
+	Layout               string        `json:"layout"`
+}
+
+type vaultConfig struct {
+	Address   string        `json:"address"`
+	Token     string        `json:"token" secret:"true"`
+	TokenFile string        `json:"token-file"`
+	Namespace string        `json:"namespace"`
+	Timeout   time.Duration `json:"timeout"`
+}
+
+type execSecretsConfig struct {
+	Timeout time.Duration `json:"timeout"`
+}
+
+type secretsConfig struct {
+	Vault vaultConfig       `json:"vault"`
+	Exec  execSecretsConfig `json:"exec"`
+}
+
+type timeoutsConfig struct {
+	Snapshot  time.Duration `json:"snapshot"`
+	Upload    time.Duration `json:"upload"`
+	Retention time.Duration `json:"retention"`
+}
+
+type httpConfig struct {
+	Address       string `json:"address"`
+	MaxFailedRuns int    `json:"max-failed-runs"`
+	APIToken      string `json:"api-token" secret:"true"`
+	APITokenFile  string `json:"api-token-file"`
+}
+
+type tracingConfig struct {
+	Enabled     bool    `json:"enabled"`
+	Endpoint    string  `json:"endpoint"`
+	ServiceName string  `json:"service-name"`
+	SampleRatio float64 `json:"sample-ratio"`
+}
+
+type retryConfig struct {
+	MaxAttempts    int           `json:"max-attempts"`
+	InitialBackoff time.Duration `json:"initial-backoff"`
+	MaxBackoff     time.Duration `json:"max-backoff"`
+	Jitter         float64       `json:"jitter"`
 }
 
 type config struct {
-	Cron              string            `json:"cron"`
-	Outputs           []string          `json:"outputs"`
-	ConsulConfig      consulConfig      `json:"consul"`
-	AzureOutputConfig azureOutputConfig `json:"azure-blob"`
-	LocalOutputConfig localOutputConfig `json:"local"`
-	FilenamePrefix    string            `json:"filename-prefix"`
-	FileExtension     string            `json:"file-extension"`
-	LogLevel          string            `json:"log-level"`
+	Cron                string              `json:"cron"`
+	Outputs             []outputConfig      `json:"outputs"`
+	ConsulConfig        consulConfig        `json:"consul"`
+	AzureOutputConfig   azureOutputConfig   `json:"azure-blob"`
+	LocalOutputConfig   localOutputConfig   `json:"local"`
+	Timeouts            timeoutsConfig      `json:"timeouts"`
+	Retry               retryConfig         `json:"retry"`
+	Bandwidth           bandwidthConfig     `json:"bandwidth"`
+	SkipUnchanged       skipUnchangedConfig `json:"skip-unchanged"`
+	Force               bool                `json:"force"`
+	SanityChecks        sanityChecksConfig  `json:"sanity-checks"`
+	VerifyRestore       verifyRestoreConfig `json:"verify-restore"`
+	Secrets             secretsConfig       `json:"secrets"`
+	HTTP                httpConfig          `json:"http"`
+	Tracing             tracingConfig       `json:"tracing"`
+	Notifications       notificationsConfig `json:"notifications"`
+	Notifiers           []notifierConfig    `json:"notifiers"`
+	Hooks               hooksConfig         `json:"hooks"`
+	FilenameTemplate    string              `json:"filename-template"`
+	FilenamePrefix      string              `json:"filename-prefix"`
+	FileExtension       string              `json:"file-extension"`
+	LogLevel            string              `json:"log-level"`
+	LogFormat           string              `json:"log-format"`
+	OutputConcurrency   uint                `json:"output-concurrency"`
+	ShutdownGracePeriod time.Duration       `json:"shutdown-grace-period"`
+	ConfigDir           string              `json:"configdir"`
+	WatchConfig         bool                `json:"watch-config"`
+	WatchDebounce       time.Duration       `json:"watch-config-debounce"`
+
+	// path of the config file that was loaded, if any
+	configFile string
+	// where each setting was read from, keyed as in configFields
+	sources map[string]string
 }
 
 func regFlagString(flag string, value string, usage string) {
@@ -94,137 +203,392 @@ func regFlagUint(flag string, value uint, usage string) {
 	}
 }
 
-func (c *config) loadConfig() error {
-
-	// set defaults
-	viper.SetDefault("filename-prefix", "consul-snapshot-")
-	viper.SetDefault("file-extension", ".snap")
-	viper.SetDefault("configdir", ".")
-	viper.SetDefault("log-level", "info")
-	viper.SetDefault("consul.url", "http://127.0.0.1:8500")
-	viper.SetDefault("consul.lock-key", "consul-snapshotter/.lock")
-	viper.SetDefault("consul.lock-timeout", 10*time.Minute)
-	viper.SetDefault("outputs", []string{"local"})
-	viper.SetDefault("local.destination-path", ".")
-	viper.SetDefault("local.create-destination", false)
-	viper.SetDefault("local.retention-period", 0)
-	viper.SetDefault("azure-blob.cloud-domain", "blob.core.windows.net")
-	viper.SetDefault("azure-blob.create-container", false)
-	viper.SetDefault("azure-blob.block-size", 4*1024*1024)
-	viper.SetDefault("azure-blob.parallelism", 16)
-	viper.SetDefault("azure-blob.retention-period", 0)
-	viper.SetDefault("azure-blob.emulated", false)
-	viper.SetDefault("azure-blob.emulator-url", "http://127.0.0.1:10000")
-
-	// read command flags
-	regFlagString("configdir", viper.GetString("configdir"), "The path to look for the configuration file")
-	regFlagString("cron", viper.GetString("cron"), "Cron expression to define when to run")
-	regFlagString("filename-prefix", viper.GetString("filename-prefix"), "Prefix to use in the snapshot name")
-	regFlagString("file-extension", viper.GetString("file-extension"), "File extension to use in the snapshot name")
-	regFlagString("log-level", viper.GetString("log-level"), "Verbosity (info, warn, debug) of the log")
-	regFlagString("consul.url", viper.GetString("consul.url"), "Consul Agent URL")
-	regFlagString("consul.token", viper.GetString("consul.token"), "Consul Agent authentication token")
-	regFlagString("consul.lock-key", viper.GetString("consul.lock-key"), "Key to use in the KV lock")
-	regFlagDuration("consul.lock-timeout", viper.GetDuration("consul.lock-timeout"), "Timeout for the session lock")
-	regFlagStringSliceP("outputs", "o", viper.GetStringSlice("outputs"), "List of outputs to push the snapshot to")
+func regFlagInt(flag string, value int, usage string) {
+	if pflag.Lookup(flag) == nil {
+		pflag.Int(flag, value, usage)
+	}
+}
+
+func regFlagFloat64(flag string, value float64, usage string) {
+	if pflag.Lookup(flag) == nil {
+		pflag.Float64(flag, value, usage)
+	}
+}
+
+// envBindings maps settings to the env vars they can be read from
+var envBindings = []struct {
+	key string
+	env string
+}{
+	{"consul.url", "CONSUL_HTTP_ADDR"},
+	{"consul.token", "CONSUL_HTTP_TOKEN"},
+	{"azure-blob.cloud-domain", "AZURE_CLOUD_DOMAIN"},
+	{"azure-blob.storage-account", "AZURE_STORAGE_ACCOUNT"},
+	{"azure-blob.storage-access-key", "AZURE_STORAGE_ACCESS_KEY"},
+	{"azure-blob.storage-sas-token", "AZURE_STORAGE_SAS_TOKEN"},
+	{"secrets.vault.address", "VAULT_ADDR"},
+	{"secrets.vault.token", "VAULT_TOKEN"},
+	{"secrets.vault.namespace", "VAULT_NAMESPACE"},
+}
+
+// setDefaults sets the default value of every setting
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("filename-template", naming.DefaultTemplate)
+	v.SetDefault("filename-prefix", "consul-snapshot-")
+	v.SetDefault("file-extension", ".snap")
+	v.SetDefault("configdir", ".")
+	v.SetDefault("log-level", "info")
+	v.SetDefault("log-format", logger.FormatText)
+	v.SetDefault("shutdown-grace-period", 25*time.Second)
+	v.SetDefault("watch-config", false)
+	v.SetDefault("watch-config-debounce", 2*time.Second)
+	v.SetDefault("consul.url", "http://127.0.0.1:8500")
+	v.SetDefault("consul.lock-key", "consul-snapshotter/.lock")
+	v.SetDefault("consul.lock-timeout", 10*time.Minute)
+	v.SetDefault("consul.state-key", "consul-snapshotter/state")
+	v.SetDefault("skip-unchanged.enabled", false)
+	v.SetDefault("skip-unchanged.max-interval", 24*time.Hour)
+	v.SetDefault("force", false)
+	v.SetDefault("sanity-checks.min-kv-entries", 0)
+	v.SetDefault("sanity-checks.min-nodes", 0)
+	v.SetDefault("sanity-checks.min-services", 0)
+	v.SetDefault("sanity-checks.required-kv-prefixes", []string{})
+	v.SetDefault("sanity-checks.max-shrink", 0)
+	v.SetDefault("verify-restore.schedule", "")
+	v.SetDefault("verify-restore.consul-binary", "consul")
+	v.SetDefault("verify-restore.timeout", 10*time.Minute)
+	v.SetDefault("outputs", []string{"local"})
+	v.SetDefault("output-concurrency", 4)
+	v.SetDefault("local.destination-path", ".")
+	v.SetDefault("local.create-destination", false)
+	v.SetDefault("local.retention-period", 0)
+	v.SetDefault("local.layout", outputs.LayoutFlat)
+	v.SetDefault("azure-blob.cloud-domain", "blob.core.windows.net")
+	v.SetDefault("azure-blob.create-container", false)
+	v.SetDefault("azure-blob.block-size", 4*1024*1024)
+	v.SetDefault("azure-blob.parallelism", 16)
+	v.SetDefault("azure-blob.retention-period", 0)
+	v.SetDefault("azure-blob.emulated", false)
+	v.SetDefault("azure-blob.emulator-url", "http://127.0.0.1:10000")
+	v.SetDefault("azure-blob.layout", outputs.LayoutFlat)
+	v.SetDefault("timeouts.snapshot", 10*time.Minute)
+	v.SetDefault("timeouts.upload", 30*time.Minute)
+	v.SetDefault("timeouts.retention", 10*time.Minute)
+	v.SetDefault("retry.max-attempts", 3)
+	v.SetDefault("retry.initial-backoff", 5*time.Second)
+	v.SetDefault("retry.max-backoff", time.Minute)
+	v.SetDefault("retry.jitter", 0.2)
+	v.SetDefault("bandwidth.limit", "0")
+	v.SetDefault("notifications.timeout", 10*time.Second)
+	v.SetDefault("notifications.digest-schedule", "0 0 9 * * *")
+	v.SetDefault("http.address", "")
+	v.SetDefault("http.max-failed-runs", 3)
+	v.SetDefault("hooks.timeout", time.Minute)
+	v.SetDefault("tracing.enabled", false)
+	v.SetDefault("tracing.endpoint", "")
+	v.SetDefault("tracing.service-name", "consul-snapshotter")
+	v.SetDefault("tracing.sample-ratio", 1.0)
+	v.SetDefault("secrets.vault.timeout", 10*time.Second)
+	v.SetDefault("secrets.exec.timeout", 10*time.Second)
+}
+
+// registerFlags declares the command flags, using the defaults set in v
+func registerFlags(v *viper.Viper) {
+	regFlagString("configdir", v.GetString("configdir"), "The path to look for the configuration file")
+	regFlagBool("watch-config", v.GetBool("watch-config"), "Reload the config every time the config file changes (default: false)")
+	regFlagDuration("watch-config-debounce", v.GetDuration("watch-config-debounce"), "Time to wait for the config file to settle before reloading it")
+	regFlagString("cron", v.GetString("cron"), "Cron expression to define when to run")
+	regFlagString("filename-template", v.GetString("filename-template"), "Go template of the snapshot file names, which may contain directories (see README)")
+	regFlagString("filename-prefix", v.GetString("filename-prefix"), "Prefix to use in the snapshot name")
+	regFlagString("file-extension", v.GetString("file-extension"), "File extension to use in the snapshot name")
+	regFlagString("log-level", v.GetString("log-level"), "Verbosity (info, warn, debug) of the log")
+	regFlagString("log-format", v.GetString("log-format"), "Format of the log: text, or json for one object per line")
+	regFlagDuration("shutdown-grace-period", v.GetDuration("shutdown-grace-period"), "Time to wait for an in-flight backup to finish on SIGTERM/SIGINT before cancelling it")
+	regFlagString("consul.url", v.GetString("consul.url"), "Consul Agent URL")
+	regFlagString("consul.token", v.GetString("consul.token"), "Consul Agent authentication token")
+	regFlagString("consul.token-file", "", "File to read the Consul Agent authentication token from")
+	regFlagString("consul.lock-key", v.GetString("consul.lock-key"), "Key to use in the KV lock")
+	regFlagDuration("consul.lock-timeout", v.GetDuration("consul.lock-timeout"), "Timeout for the session lock")
+	regFlagString("consul.state-key", v.GetString("consul.state-key"), "Key to record the last snapshot uploaded to each output in, with skip-unchanged, and the last one that passed sanity-checks.max-shrink")
+	regFlagBool("skip-unchanged.enabled", v.GetBool("skip-unchanged.enabled"), "Skip the outputs that hold a snapshot of the same cluster state already (default: false)")
+	regFlagDuration("skip-unchanged.max-interval", v.GetDuration("skip-unchanged.max-interval"), "Maximum time without uploading a snapshot to an output, even if the cluster did not change (0 - no maximum)")
+	regFlagBool("force", v.GetBool("force"), "Upload the snapshot to every output, even if the cluster did not change (default: false)")
+	regFlagInt("sanity-checks.min-kv-entries", v.GetInt("sanity-checks.min-kv-entries"), "Minimum number of KV entries in the snapshot, besides the keys of the snapshotter (0 - no check)")
+	regFlagInt("sanity-checks.min-nodes", v.GetInt("sanity-checks.min-nodes"), "Minimum number of nodes registered in the snapshot (0 - no check)")
+	regFlagInt("sanity-checks.min-services", v.GetInt("sanity-checks.min-services"), "Minimum number of services, by name, registered in the snapshot (0 - no check)")
+	regFlagStringSliceP("sanity-checks.required-kv-prefixes", "", v.GetStringSlice("sanity-checks.required-kv-prefixes"), "KV prefixes that must hold at least one entry in the snapshot")
+	regFlagFloat64("sanity-checks.max-shrink", v.GetFloat64("sanity-checks.max-shrink"), "Share of its size the snapshot may lose since the last one that passed the checks, from 0 to 1 (0 - no check)")
+	regFlagString("verify-restore.schedule", v.GetString("verify-restore.schedule"), "Cron expression to define when to verify that the latest snapshot can be restored (default: \"\" - only with the verify-restore command)")
+	regFlagString("verify-restore.output", "", "Output to restore the latest snapshot of (default: the first one)")
+	regFlagString("verify-restore.consul-binary", v.GetString("verify-restore.consul-binary"), "Consul binary to start a dev agent with, to restore the snapshot into")
+	regFlagString("verify-restore.url", "", "URL of a scratch Consul cluster to restore the snapshot into, instead of a dev agent (its state is replaced)")
+	regFlagString("verify-restore.token-file", "", "File to read the token of the scratch Consul cluster from")
+	regFlagDuration("verify-restore.timeout", v.GetDuration("verify-restore.timeout"), "Maximum time to verify that the latest snapshot can be restored")
+	regFlagStringSliceP("outputs", "o", v.GetStringSlice("outputs"), "List of output types to push the snapshot to (named outputs can be set in the config file)")
+	regFlagUint("output-concurrency", v.GetUint("output-concurrency"), "Maximum number of outputs to push the snapshot to at the same time")
 	regFlagString("azure-blob.container-name", "", "Name of the Azure Blob container to use")
 	regFlagString("azure-blob.container-path", "", "Path to use inside the Azure Blob container")
 	regFlagString("azure-blob.storage-account", "", "Azure Blob storage account to use")
-	regFlagString("azure-blob.cloud-domain", viper.GetString("azure-blob.cloud-domain"), "The domain for the Azure Blob service, depending on the cloud you are using")
+	regFlagString("azure-blob.cloud-domain", v.GetString("azure-blob.cloud-domain"), "The domain for the Azure Blob service, depending on the cloud you are using")
 	regFlagString("azure-blob.storage-access-key", "", "Azure Blob storage access key to use (mutually exclusive with azure-blob.storage-sas-token)")
+	regFlagString("azure-blob.storage-access-key-file", "", "File to read the Azure Blob storage access key from")
 	regFlagString("azure-blob.storage-sas-token", "", "Azure Blob storage SAS token to use (mutually exclusive with azure-blob.storage-access-key)")
-	regFlagBool("azure-blob.create-container", viper.GetBool("azure-blob.create-container"), "Behavior when the container-name does not exist (default: false)")
-	regFlagInt64("azure-blob.block-size", viper.GetInt64("azure-blob.block-size"), "Size in bytes of each block")
-	regFlagUint("azure-blob.parallelism", viper.GetUint("azure-blob.parallelism"), "Maximum number of blocks to upload in parallel")
-	regFlagDuration("azure-blob.retention-period", viper.GetDuration("azure-blob.retention-period"), "Duration that Azure Blob snapshots need to be retained (default: \"0s\" - keep forever)")
-	regFlagBool("azure-blob.emulated", viper.GetBool("azure-blob.emulated"), "If enabled, it will try to connect to a local Azure Blob Emulator using <emulator-url>/<storage-account>/<container-name> (default: false)")
-	regFlagString("azure-blob.emulator-url", viper.GetString("azure-blob.emulator-url"), "URL of the Azure Blob Emulator")
-	regFlagString("local.destination-path", viper.GetString("local.destination-path"), "Local path where to save the snapshots")
-	regFlagBool("local.create-destination", viper.GetBool("local.create-destination"), "Behavior when the destination-path does not exist (default: false)")
-	regFlagDuration("local.retention-period", viper.GetDuration("local.retention-period"), "Duration that Local snapshots need to be retained (default: \"0s\" - keep forever)")
+	regFlagString("azure-blob.storage-sas-token-file", "", "File to read the Azure Blob storage SAS token from")
+	regFlagBool("azure-blob.create-container", v.GetBool("azure-blob.create-container"), "Behavior when the container-name does not exist (default: false)")
+	regFlagInt64("azure-blob.block-size", v.GetInt64("azure-blob.block-size"), "Size in bytes of each block")
+	regFlagUint("azure-blob.parallelism", v.GetUint("azure-blob.parallelism"), "Maximum number of blocks to upload in parallel")
+	regFlagDuration("azure-blob.retention-period", v.GetDuration("azure-blob.retention-period"), "Duration that Azure Blob snapshots need to be retained (default: \"0s\" - keep forever)")
+	regFlagBool("azure-blob.emulated", v.GetBool("azure-blob.emulated"), "If enabled, it will try to connect to a local Azure Blob Emulator using <emulator-url>/<storage-account>/<container-name> (default: false)")
+	regFlagString("azure-blob.emulator-url", v.GetString("azure-blob.emulator-url"), "URL of the Azure Blob Emulator")
+	regFlagString("azure-blob.layout", v.GetString("azure-blob.layout"), "Layout of the snapshots in container-path: flat, or date to save them in YYYY/MM/DD/ directories")
+	regFlagString("local.destination-path", v.GetString("local.destination-path"), "Local path where to save the snapshots")
+	regFlagBool("local.create-destination", v.GetBool("local.create-destination"), "Behavior when the destination-path does not exist (default: false)")
+	regFlagDuration("local.retention-period", v.GetDuration("local.retention-period"), "Duration that Local snapshots need to be retained (default: \"0s\" - keep forever)")
+	regFlagString("local.layout", v.GetString("local.layout"), "Layout of the snapshots in destination-path: flat, or date to save them in YYYY/MM/DD/ directories")
+	regFlagDuration("timeouts.snapshot", v.GetDuration("timeouts.snapshot"), "Maximum time to take and verify the snapshot (0 - no timeout)")
+	regFlagDuration("timeouts.upload", v.GetDuration("timeouts.upload"), "Maximum time for each output to save the snapshot (0 - no timeout)")
+	regFlagDuration("timeouts.retention", v.GetDuration("timeouts.retention"), "Maximum time for each output to apply its retention policy (0 - no timeout)")
+	regFlagInt("retry.max-attempts", v.GetInt("retry.max-attempts"), "Maximum number of attempts of each output to save the snapshot and to apply its retention policy (1 - no retries)")
+	regFlagDuration("retry.initial-backoff", v.GetDuration("retry.initial-backoff"), "Time to wait before the first retry, doubled before each of the next ones")
+	regFlagDuration("retry.max-backoff", v.GetDuration("retry.max-backoff"), "Maximum time to wait between retries")
+	regFlagFloat64("retry.jitter", v.GetFloat64("retry.jitter"), "Fraction of each wait between retries to randomize it by")
+	regFlagString("bandwidth.limit", v.GetString("bandwidth.limit"), "Maximum bytes per second written by all the outputs together, e.g. 10MiB (0 - no limit)")
+	regFlagDuration("notifications.timeout", v.GetDuration("notifications.timeout"), "Maximum time to send each notification")
+	regFlagString("notifications.digest-schedule", v.GetString("notifications.digest-schedule"), "Cron expression to define when to send the digests, to the notifiers that want them")
+	regFlagString("http.address", v.GetString("http.address"), "Address (host:port) to serve the metrics, health and status endpoints on (default: \"\" - disabled)")
+	regFlagString("http.api-token-file", "", "File to read the bearer token of the control API from (the API is disabled without a token)")
+	regFlagInt("http.max-failed-runs", v.GetInt("http.max-failed-runs"), "Number of backup runs in a row that can fail before /readyz reports not ready")
+	regFlagDuration("hooks.timeout", v.GetDuration("hooks.timeout"), "Maximum time for each hook to run, unless it sets its own timeout (0 - no timeout)")
+	regFlagBool("tracing.enabled", v.GetBool("tracing.enabled"), "Export traces of the backup runs over OTLP/HTTP (default: false)")
+	regFlagString("tracing.endpoint", v.GetString("tracing.endpoint"), "URL of the OTLP/HTTP collector to export the traces to (default: \"\" - from the OTEL_EXPORTER_OTLP_ENDPOINT env vars, or http://localhost:4318)")
+	regFlagString("tracing.service-name", v.GetString("tracing.service-name"), "Service name of the traces")
+	regFlagFloat64("tracing.sample-ratio", v.GetFloat64("tracing.sample-ratio"), "Share of the backup runs to trace, from 0 to 1")
+	regFlagString("secrets.vault.address", "", "Address of the Vault server to read \"vault:\" secrets from")
+	regFlagString("secrets.vault.token-file", "", "File to read the Vault token from")
+	regFlagString("secrets.vault.namespace", "", "Vault namespace to read secrets from")
+	regFlagDuration("secrets.vault.timeout", v.GetDuration("secrets.vault.timeout"), "Timeout for reading a secret from Vault")
+	regFlagDuration("secrets.exec.timeout", v.GetDuration("secrets.exec.timeout"), "Timeout for the commands of \"exec:\" secrets")
 	regFlagBoolP("help", "h", false, "Prints this help message")
 	regFlagBoolP("version", "V", false, "Prints the version")
+}
 
-	pflag.Parse()
+// parseFlags parses the command line, handling --help and --version
+func parseFlags() {
+	v := viper.New()
+	setDefaults(v)
+	registerFlags(v)
 
-	if err := viper.BindPFlags(pflag.CommandLine); err != nil {
-		return err
-	}
+	pflag.Parse()
 
 	// print usage if --help or -h
-	if viper.GetBool("help") {
+	if help, _ := pflag.CommandLine.GetBool("help"); help {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(os.Stderr, "  %-18s %s\n", cmd.name, cmd.usage)
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
 		pflag.PrintDefaults()
 		os.Exit(0)
 	}
 
 	// print version if --version or -V
-	if viper.GetBool("version") {
-		fmt.Fprintf(os.Stderr, "Version: %s\n", version.Version)
-		fmt.Fprintf(os.Stderr, "(Build date: %s, Git commit: %s)\n", version.BuildDate, version.GitCommit)
+	if version, _ := pflag.CommandLine.GetBool("version"); version {
+		printVersion()
 		os.Exit(0)
 	}
+}
+
+func printVersion() {
+	fmt.Fprintf(os.Stderr, "Version: %s\n", version.Version)
+	fmt.Fprintf(os.Stderr, "(Build date: %s, Git commit: %s)\n", version.BuildDate, version.GitCommit)
+}
+
+// loadConfig builds a new config from the defaults, the config file, env vars and the parsed command flags.
+// Each call uses its own viper instance, so that a reload never touches the config in use.
+func loadConfig() (*config, error) {
+	v := viper.New()
+	setDefaults(v)
+
+	if err := v.BindPFlags(pflag.CommandLine); err != nil {
+		return nil, err
+	}
 
 	// bind env vars
-	viper.BindEnv("consul.url", "CONSUL_HTTP_ADDR")
-	viper.BindEnv("consul.token", "CONSUL_HTTP_TOKEN")
-	viper.BindEnv("azure-blob.cloud-domain", "AZURE_CLOUD_DOMAIN")
-	viper.BindEnv("azure-blob.storage-account", "AZURE_STORAGE_ACCOUNT")
-	viper.BindEnv("azure-blob.storage-access-key", "AZURE_STORAGE_ACCESS_KEY")
-	viper.BindEnv("azure-blob.storage-sas-token", "AZURE_STORAGE_SAS_TOKEN")
+	for _, b := range envBindings {
+		v.BindEnv(b.key, b.env)
+	}
 
 	// load config from file
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(viper.GetString("configdir"))
+	v.SetConfigName("config")
+	v.SetConfigType("yaml")
+	v.AddConfigPath(v.GetString("configdir"))
 
-	if err := viper.ReadInConfig(); err != nil {
+	if err := v.ReadInConfig(); err != nil {
+		var notFound viper.ConfigFileNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, fmt.Errorf("could not load config file: %v", err)
+		}
 		logger.Warn("Could not load config file: ", err)
 	}
 
 	// Consul config
 	consulConfig := &consulConfig{}
-	consulConfig.URL = viper.GetString("consul.url")
-	consulConfig.Token = viper.GetString("consul.token")
-	consulConfig.LockKey = viper.GetString("consul.lock-key")
-	consulConfig.LockTimeout = viper.GetDuration("consul.lock-timeout")
-
-	// Azure Blob output config
-	azureOutputConfig := &azureOutputConfig{}
-	azureOutputConfig.ContainerName = viper.GetString("azure-blob.container-name")
-	azureOutputConfig.ContainerPath = viper.GetString("azure-blob.container-path")
-	azureOutputConfig.StorageAccount = viper.GetString("azure-blob.storage-account")
-	azureOutputConfig.CloudDomain = viper.GetString("azure-blob.cloud-domain")
-	azureOutputConfig.StorageAccessKey = viper.GetString("azure-blob.storage-access-key")
-	azureOutputConfig.StorageSASToken = viper.GetString("azure-blob.storage-sas-token")
-	azureOutputConfig.CreateContainer = viper.GetBool("azure-blob.create-container")
-	azureOutputConfig.BlockSize = viper.GetInt64("azure-blob.block-size")
-	azureOutputConfig.Parallelism = uint16(viper.GetUint("azure-blob.parallelism"))
-	azureOutputConfig.RetentionPeriod = viper.GetDuration("azure-blob.retention-period")
-	azureOutputConfig.Emulated = viper.GetBool("azure-blob.emulated")
-	azureOutputConfig.EmulatorUrl = viper.GetString("azure-blob.emulator-url")
-
-	// Local output config
-	localOutputConfig := &localOutputConfig{}
-	localOutputConfig.DestinationPath = viper.GetString("local.destination-path")
-	localOutputConfig.RetentionPeriod = viper.GetDuration("local.retention-period")
-	localOutputConfig.CreateDestination = viper.GetBool("local.create-destination")
-
-	c.Cron = viper.GetString("cron")
-	c.FilenamePrefix = viper.GetString("filename-prefix")
-	c.FileExtension = viper.GetString("file-extension")
-	c.LogLevel = viper.GetString("log-level")
-	c.Outputs = viper.GetStringSlice("outputs")
+	consulConfig.URL = v.GetString("consul.url")
+	consulConfig.Token = v.GetString("consul.token")
+	consulConfig.TokenFile = v.GetString("consul.token-file")
+	consulConfig.LockKey = v.GetString("consul.lock-key")
+	consulConfig.LockTimeout = v.GetDuration("consul.lock-timeout")
+	consulConfig.StateKey = v.GetString("consul.state-key")
+
+	// Timeouts config
+	timeoutsConfig := &timeoutsConfig{}
+	timeoutsConfig.Snapshot = v.GetDuration("timeouts.snapshot")
+	timeoutsConfig.Upload = v.GetDuration("timeouts.upload")
+	timeoutsConfig.Retention = v.GetDuration("timeouts.retention")
+
+	// Secrets config
+	secretsConfig := &secretsConfig{}
+	secretsConfig.Vault.Address = v.GetString("secrets.vault.address")
+	secretsConfig.Vault.Token = v.GetString("secrets.vault.token")
+	secretsConfig.Vault.TokenFile = v.GetString("secrets.vault.token-file")
+	secretsConfig.Vault.Namespace = v.GetString("secrets.vault.namespace")
+	secretsConfig.Vault.Timeout = v.GetDuration("secrets.vault.timeout")
+	secretsConfig.Exec.Timeout = v.GetDuration("secrets.exec.timeout")
+
+	c := &config{}
+	c.Cron = v.GetString("cron")
+	c.FilenameTemplate = v.GetString("filename-template")
+	c.FilenamePrefix = v.GetString("filename-prefix")
+	c.FileExtension = v.GetString("file-extension")
+	c.LogLevel = v.GetString("log-level")
+	c.LogFormat = v.GetString("log-format")
+	c.OutputConcurrency = v.GetUint("output-concurrency")
+	c.ShutdownGracePeriod = v.GetDuration("shutdown-grace-period")
+	c.ConfigDir = v.GetString("configdir")
+	c.WatchConfig = v.GetBool("watch-config")
+	c.WatchDebounce = v.GetDuration("watch-config-debounce")
 	c.ConsulConfig = *consulConfig
-	c.AzureOutputConfig = *azureOutputConfig
-	c.LocalOutputConfig = *localOutputConfig
+	c.AzureOutputConfig = readAzureOutputConfig(v, "azure-blob.")
+	c.LocalOutputConfig = readLocalOutputConfig(v, "local.")
+	c.Timeouts = *timeoutsConfig
+	c.Retry = readRetryConfig(v, "retry.")
+	c.Bandwidth = readBandwidthConfig(v, "bandwidth.")
+	c.SkipUnchanged.Enabled = v.GetBool("skip-unchanged.enabled")
+	c.SkipUnchanged.MaxInterval = v.GetDuration("skip-unchanged.max-interval")
+	c.Force = v.GetBool("force")
+	c.SanityChecks.MinKVEntries = v.GetInt("sanity-checks.min-kv-entries")
+	c.SanityChecks.MinNodes = v.GetInt("sanity-checks.min-nodes")
+	c.SanityChecks.MinServices = v.GetInt("sanity-checks.min-services")
+	c.SanityChecks.RequiredKVPrefixes = v.GetStringSlice("sanity-checks.required-kv-prefixes")
+	c.SanityChecks.MaxShrink = v.GetFloat64("sanity-checks.max-shrink")
+	c.VerifyRestore.Schedule = v.GetString("verify-restore.schedule")
+	c.VerifyRestore.Output = v.GetString("verify-restore.output")
+	c.VerifyRestore.ConsulBinary = v.GetString("verify-restore.consul-binary")
+	c.VerifyRestore.URL = v.GetString("verify-restore.url")
+	c.VerifyRestore.Token = v.GetString("verify-restore.token")
+	c.VerifyRestore.TokenFile = v.GetString("verify-restore.token-file")
+	c.VerifyRestore.Timeout = v.GetDuration("verify-restore.timeout")
+	c.Secrets = *secretsConfig
+	c.HTTP.Address = v.GetString("http.address")
+	c.HTTP.MaxFailedRuns = v.GetInt("http.max-failed-runs")
+	c.HTTP.APIToken = v.GetString("http.api-token")
+	c.HTTP.APITokenFile = v.GetString("http.api-token-file")
+	c.Tracing.Enabled = v.GetBool("tracing.enabled")
+	c.Tracing.Endpoint = v.GetString("tracing.endpoint")
+	c.Tracing.ServiceName = v.GetString("tracing.service-name")
+	c.Tracing.SampleRatio = v.GetFloat64("tracing.sample-ratio")
+
+	outputs, err := readOutputsConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	c.Outputs = outputs
+
+	c.Notifications.Timeout = v.GetDuration("notifications.timeout")
+	c.Notifications.DigestSchedule = v.GetString("notifications.digest-schedule")
+	notifiers, err := readNotifiersConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	c.Notifiers = notifiers
+
+	hooks, err := readHooksConfig(v)
+	if err != nil {
+		return nil, err
+	}
+	c.Hooks = hooks
+
+	c.configFile = v.ConfigFileUsed()
+	c.sources = settingSources(v, c)
+
+	// read the secrets from files and secret providers, every time the config is loaded
+	if err := resolveSecrets(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
 
-	return nil
+// readAzureOutputConfig reads the Azure Blob output settings under prefix (e.g. "azure-blob.")
+func readAzureOutputConfig(v *viper.Viper, prefix string) azureOutputConfig {
+	azureOutputConfig := azureOutputConfig{}
+	azureOutputConfig.ContainerName = v.GetString(prefix + "container-name")
+	azureOutputConfig.ContainerPath = v.GetString(prefix + "container-path")
+	azureOutputConfig.StorageAccount = v.GetString(prefix + "storage-account")
+	azureOutputConfig.CloudDomain = v.GetString(prefix + "cloud-domain")
+	azureOutputConfig.StorageAccessKey = v.GetString(prefix + "storage-access-key")
+	azureOutputConfig.StorageAccessKeyFile = v.GetString(prefix + "storage-access-key-file")
+	azureOutputConfig.StorageSASToken = v.GetString(prefix + "storage-sas-token")
+	azureOutputConfig.StorageSASTokenFile = v.GetString(prefix + "storage-sas-token-file")
+	azureOutputConfig.CreateContainer = v.GetBool(prefix + "create-container")
+	azureOutputConfig.BlockSize = v.GetInt64(prefix + "block-size")
+	azureOutputConfig.Parallelism = uint16(v.GetUint(prefix + "parallelism"))
+	azureOutputConfig.RetentionPeriod = v.GetDuration(prefix + "retention-period")
+	azureOutputConfig.Emulated = v.GetBool(prefix + "emulated")
+	azureOutputConfig.EmulatorUrl = v.GetString(prefix + "emulator-url")
+	azureOutputConfig.Layout = v.GetString(prefix + "layout")
+	return azureOutputConfig
 }
 
+// readLocalOutputConfig reads the local output settings under prefix (e.g. "local.")
+func readLocalOutputConfig(v *viper.Viper, prefix string) localOutputConfig {
+	localOutputConfig := localOutputConfig{}
+	localOutputConfig.DestinationPath = v.GetString(prefix + "destination-path")
+	localOutputConfig.RetentionPeriod = v.GetDuration(prefix + "retention-period")
+	localOutputConfig.CreateDestination = v.GetBool(prefix + "create-destination")
+	localOutputConfig.Layout = v.GetString(prefix + "layout")
+	return localOutputConfig
+}
+
+// readRetryConfig reads the retry policy settings under prefix (e.g. "retry.")
+func readRetryConfig(v *viper.Viper, prefix string) retryConfig {
+	retryConfig := retryConfig{}
+	retryConfig.MaxAttempts = v.GetInt(prefix + "max-attempts")
+	retryConfig.InitialBackoff = v.GetDuration(prefix + "initial-backoff")
+	retryConfig.MaxBackoff = v.GetDuration(prefix + "max-backoff")
+	retryConfig.Jitter = v.GetFloat64(prefix + "jitter")
+	return retryConfig
+}
+
+// policy returns the retry policy of rc
+func (rc retryConfig) policy() retry.Policy {
+	return retry.Policy{
+		MaxAttempts:    rc.MaxAttempts,
+		InitialBackoff: rc.InitialBackoff,
+		MaxBackoff:     rc.MaxBackoff,
+		Jitter:         rc.Jitter,
+	}
+}
+
+// String returns the settings as JSON, with secrets redacted
 func (c *config) String() string {
-	conf, err := json.MarshalIndent(c, "", "  ")
-	// conf, err := json.Marshal(c)
+	settings := map[string]string{}
+	for _, f := range configFields(c) {
+		settings[f.Key] = f.DisplayValue()
+	}
+	conf, err := json.MarshalIndent(settings, "", "  ")
 	if err != nil {
 		return err.Error()
 	}
@@ -2,6 +2,8 @@ package consul
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,10 +12,15 @@ import (
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/snapshot"
 	"github.com/rboyer/safeio"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/tracing"
 )
 
+// ErrLockBusy is returned by AcquireLock when another process holds the lock
+var ErrLockBusy = errors.New("lock is acquired by another resource")
+
 type Worker struct {
 	client         *api.Client
 	key            string
@@ -42,48 +49,129 @@ func NewConsul(consulURL, consulToken, key string, sessionTimeout time.Duration)
 	return w, nil
 }
 
-func (w *Worker) GetSnapshot() (string, error) {
+// Snapshot is a verified snapshot saved to a temporary file
+type Snapshot struct {
+	// File is the path of the temporary file
+	File string
+	// LastIndex is the Raft index the snapshot was taken at
+	LastIndex uint64
+	// Size is the size of the file in bytes
+	Size int64
+}
 
-	var buf bytes.Buffer
+// AgentInfo describes the Consul agent the snapshots are taken through
+type AgentInfo struct {
+	Datacenter string
+	NodeName   string
+}
 
-	// Take the snapshot
-	snap, metadata, err := w.client.Snapshot().Save(&api.QueryOptions{})
-	if err != nil {
-		return "", fmt.Errorf("error requesting the snapshot: %v", err)
+// GetAgentInfo reads the datacenter and node name of the agent
+func (w *Worker) GetAgentInfo(ctx context.Context) (*AgentInfo, error) {
+	var self struct {
+		Config struct {
+			Datacenter string
+			NodeName   string
+		}
 	}
-	defer snap.Close()
-	logger.Info(fmt.Sprintf("Performed snapshot (up to index=%d)", metadata.LastIndex))
+	if _, err := w.client.Raw().Query("/v1/agent/self", &self, (&api.QueryOptions{}).WithContext(ctx)); err != nil {
+		return nil, fmt.Errorf("error reading the agent info: %v", err)
+	}
+	return &AgentInfo{Datacenter: self.Config.Datacenter, NodeName: self.Config.NodeName}, nil
+}
 
-	tee := io.TeeReader(snap, &buf)
+// GetSnapshot takes a snapshot, verifies it and saves it to a temporary file, which the caller must remove
+func (w *Worker) GetSnapshot(ctx context.Context) (_ *Snapshot, err error) {
+	ctx, span := tracing.Start(ctx, "consul.snapshot")
+	defer func() { tracing.End(span, err) }()
+
+	// Take the snapshot, downloading it whole before verifying it, so that each step is timed on its own
+	var buf bytes.Buffer
+	metadata, err := w.downloadSnapshot(ctx, &buf)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(tracing.AttrIndex.Int64(int64(metadata.LastIndex)), tracing.AttrBytes.Int(buf.Len()))
+	log := logger.FromContext(ctx)
+	log.Info(fmt.Sprintf("Performed snapshot (up to index=%d)", metadata.LastIndex))
 
 	// Verify the snapshot
-	if _, err := snapshot.Verify(tee); err != nil {
-		return "", fmt.Errorf("error verifying snapshot: %v", err)
+	_, verifySpan := tracing.Start(ctx, "consul.snapshot.verify", tracing.AttrBytes.Int(buf.Len()))
+	_, err = snapshot.Verify(bytes.NewReader(buf.Bytes()))
+	tracing.End(verifySpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying snapshot: %v", err)
 	}
 
 	// Save the verified snapshot to a temporary location
+	_, writeSpan := tracing.Start(ctx, "consul.snapshot.write", tracing.AttrBytes.Int(buf.Len()))
+	snapFileName, size, err := writeTempFile(&buf)
+	tracing.End(writeSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Saved snapshot to temporary file: ", snapFileName)
+
+	return &Snapshot{File: snapFileName, LastIndex: metadata.LastIndex, Size: size}, nil
+}
+
+// RestoreSnapshot restores the snapshot read from r into the cluster, replacing all of its state
+func (w *Worker) RestoreSnapshot(ctx context.Context, r io.Reader) (err error) {
+	ctx, span := tracing.Start(ctx, "consul.restore")
+	defer func() { tracing.End(span, err) }()
+
+	if err := w.client.Snapshot().Restore((&api.WriteOptions{}).WithContext(ctx), r); err != nil {
+		return fmt.Errorf("error restoring the snapshot: %v", err)
+	}
+	return nil
+}
+
+// downloadSnapshot requests a snapshot and reads it into buf
+func (w *Worker) downloadSnapshot(ctx context.Context, buf *bytes.Buffer) (_ *api.QueryMeta, err error) {
+	ctx, span := tracing.Start(ctx, "consul.snapshot.download")
+	defer func() { tracing.End(span, err) }()
+
+	snap, metadata, err := w.client.Snapshot().Save((&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error requesting the snapshot: %v", err)
+	}
+	defer snap.Close()
+	if _, err := io.Copy(buf, snap); err != nil {
+		return nil, fmt.Errorf("error downloading the snapshot: %v", err)
+	}
+	span.SetAttributes(tracing.AttrIndex.Int64(int64(metadata.LastIndex)), tracing.AttrBytes.Int(buf.Len()))
+	return metadata, nil
+}
+
+// writeTempFile writes the snapshot in buf to a new temporary file, returning its name and size
+func writeTempFile(buf *bytes.Buffer) (string, int64, error) {
 	snapFile, err := os.CreateTemp("", "")
 	if err != nil {
-		return "", fmt.Errorf("error creating temp file: %v", err)
+		return "", 0, fmt.Errorf("error creating temp file: %v", err)
 	}
 	snapFileName := snapFile.Name()
-	logger.Debug("Saving snapshot to temporary file: ", snapFileName)
+	snapFile.Close()
 
-	if _, err := safeio.WriteToFile(&buf, snapFileName, 0644); err != nil {
-		return "", fmt.Errorf("error writing snapshot file: %v", err)
+	size, err := safeio.WriteToFile(buf, snapFileName, 0644)
+	if err != nil {
+		os.Remove(snapFileName)
+		return "", 0, fmt.Errorf("error writing snapshot file: %v", err)
 	}
-
-	return snapFileName, nil
+	return snapFileName, size, nil
 }
 
-func (w *Worker) AcquireLock() error {
-	// create session
+func (w *Worker) AcquireLock(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "consul.lock", attribute.String("consul.lock.key", w.key))
+	defer func() { tracing.End(span, err) }()
+
+	// create session, named after the host, so that the lock holder can be told apart
+	hostname, _ := os.Hostname()
 	sessionConf := &api.SessionEntry{
+		Name:     "consul-snapshotter@" + hostname,
 		TTL:      w.sessionTimeout,
 		Behavior: "delete",
 	}
 
-	sessionID, _, err := w.client.Session().Create(sessionConf, nil)
+	sessionID, _, err := w.client.Session().Create(sessionConf, (&api.WriteOptions{}).WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -97,17 +185,17 @@ func (w *Worker) AcquireLock() error {
 		Session: w.SessionID,
 	}
 
-	r, _, err := w.client.KV().Acquire(KVPair, nil)
+	r, _, err := w.client.KV().Acquire(KVPair, (&api.WriteOptions{}).WithContext(ctx))
 	if err != nil {
 		return err
 	}
 	if !r {
-		return fmt.Errorf("lock is acquired by another resource")
+		return ErrLockBusy
 	}
 	return nil
 }
 
-func (w *Worker) ReleaseLock() error {
+func (w *Worker) ReleaseLock(ctx context.Context) error {
 	KVPair := &api.KVPair{
 		Key:     w.key,
 		Value:   []byte(w.SessionID),
@@ -115,22 +203,83 @@ func (w *Worker) ReleaseLock() error {
 	}
 
 	// release lock
-	if _, _, err := w.client.KV().Release(KVPair, nil); err != nil {
+	if _, _, err := w.client.KV().Release(KVPair, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
 		return err
 	}
 
 	// destroy session
-	if _, err := w.client.Session().Destroy(w.SessionID, nil); err != nil {
+	if _, err := w.client.Session().Destroy(w.SessionID, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (w *Worker) RenewSession(doneChan <-chan struct{}) error {
-	err := w.client.Session().RenewPeriodic(w.sessionTimeout, w.SessionID, nil, doneChan)
+// RenewSession keeps the session alive until ctx is done
+func (w *Worker) RenewSession(ctx context.Context) error {
+	err := w.client.Session().RenewPeriodic(w.sessionTimeout, w.SessionID, (&api.WriteOptions{}).WithContext(ctx), ctx.Done())
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// GetKey reads the value of key, or nil if it does not exist
+func (w *Worker) GetKey(ctx context.Context, key string) ([]byte, error) {
+	pair, _, err := w.client.KV().Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, nil
+	}
+	return pair.Value, nil
+}
+
+// PutKey writes value to key
+func (w *Worker) PutKey(ctx context.Context, key string, value []byte) error {
+	_, err := w.client.KV().Put(&api.KVPair{Key: key, Value: value}, (&api.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+// Ping checks that the agent is reachable and the cluster has a leader
+func (w *Worker) Ping(ctx context.Context) error {
+	leader, err := w.client.Status().LeaderWithQueryOptions((&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if leader == "" {
+		return errors.New("no cluster leader")
+	}
+	return nil
+}
+
+// LockHolder describes the session holding the lock
+type LockHolder struct {
+	Session string `json:"session"`
+	Name    string `json:"name"`
+	Node    string `json:"node"`
+}
+
+// LockHolder returns the session holding the lock, or nil if the lock is free
+func (w *Worker) LockHolder(ctx context.Context) (*LockHolder, error) {
+	q := (&api.QueryOptions{}).WithContext(ctx)
+	pair, _, err := w.client.KV().Get(w.key, q)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil || pair.Session == "" {
+		return nil, nil
+	}
+
+	holder := &LockHolder{Session: pair.Session}
+	session, _, err := w.client.Session().Info(pair.Session, q)
+	if err != nil {
+		return nil, err
+	}
+	if session != nil {
+		holder.Name = session.Name
+		holder.Node = session.Node
+	}
+	return holder, nil
+}
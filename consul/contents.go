@@ -0,0 +1,115 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Contents counts what the state held by a snapshot is made of
+type Contents struct {
+	// KVEntries is the number of KV entries
+	KVEntries int
+	// KVPrefixes is the number of KV entries under each of the prefixes asked for
+	KVPrefixes map[string]int
+	// Nodes is the number of nodes registered in the catalog
+	Nodes int
+	// Services is the number of distinct services registered in the catalog, by name
+	Services int
+}
+
+// Inspect counts the contents of the snapshot file, leaving out the given KV keys,
+// and the KV entries under each of kvPrefixes
+func Inspect(file string, kvPrefixes []string, ignoreKeys ...string) (*Contents, error) {
+	ignore := map[string]bool{}
+	for _, key := range ignoreKeys {
+		ignore[key] = true
+	}
+
+	contents := &Contents{KVPrefixes: map[string]int{}}
+	for _, prefix := range kvPrefixes {
+		contents.KVPrefixes[prefix] = 0
+	}
+	services := map[string]bool{}
+
+	err := eachMessage(file, func(msgType byte, msg interface{}) error {
+		m, ok := msg.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		switch msgType {
+		case kvsMessage:
+			key := fmt.Sprint(m["Key"])
+			if ignore[key] {
+				return nil
+			}
+			contents.KVEntries++
+			for prefix := range contents.KVPrefixes {
+				if strings.HasPrefix(key, prefix) {
+					contents.KVPrefixes[prefix]++
+				}
+			}
+		case registerMessage:
+			// a node is registered on its own, then along with each of its services, then each of its checks
+			switch service := m["Service"].(type) {
+			case map[string]interface{}:
+				services[fmt.Sprint(service["Service"])] = true
+			case nil:
+				if m["Check"] == nil {
+					contents.Nodes++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	contents.Services = len(services)
+	return contents, nil
+}
+
+// Contents counts what the cluster of the agent holds, as Inspect counts a snapshot, leaving out the given KV keys
+// and nodes (e.g. a scratch agent a snapshot was restored into)
+func (w *Worker) Contents(ctx context.Context, kvPrefixes []string, ignoreKeys []string, ignoreNodes ...string) (*Contents, error) {
+	q := (&api.QueryOptions{}).WithContext(ctx)
+
+	keys, _, err := w.client.KV().Keys("", "", q)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the KV entries: %v", err)
+	}
+	nodes, _, err := w.client.Catalog().Nodes(q)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the nodes: %v", err)
+	}
+	services, _, err := w.client.Catalog().Services(q)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the services: %v", err)
+	}
+
+	contents := &Contents{KVPrefixes: map[string]int{}, Services: len(services)}
+	for _, prefix := range kvPrefixes {
+		contents.KVPrefixes[prefix] = 0
+	}
+	for _, key := range keys {
+		if slices.Contains(ignoreKeys, key) {
+			continue
+		}
+		contents.KVEntries++
+		for prefix := range contents.KVPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				contents.KVPrefixes[prefix]++
+			}
+		}
+	}
+	for _, n := range nodes {
+		if !slices.Contains(ignoreNodes, n.Node) {
+			contents.Nodes++
+		}
+	}
+	return contents, nil
+}
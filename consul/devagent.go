@@ -0,0 +1,154 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/ruizink/consul-snapshotter/tracing"
+)
+
+// DevNodeName is the node name of the dev agents
+const DevNodeName = "consul-snapshotter-verify"
+
+// devAgentStopTimeout bounds the wait for a dev agent to leave, before it is killed
+const devAgentStopTimeout = 10 * time.Second
+
+// devAgentOutputLimit bounds the output of a dev agent kept to tell why it failed
+const devAgentOutputLimit = 4096
+
+// DevAgent is a throwaway Consul agent, started in dev mode, which keeps its state in memory only
+type DevAgent struct {
+	// URL is the address of its HTTP API
+	URL string
+
+	cmd    *exec.Cmd
+	output *tailWriter
+	// closed once the process exited
+	exited chan struct{}
+	err    error
+}
+
+// StartDevAgent starts `binary agent -dev` on free local ports, and waits for it to become the leader of its own
+// cluster, until ctx is done. The agent must be stopped, and is killed if ctx is cancelled meanwhile.
+func StartDevAgent(ctx context.Context, binary string) (_ *DevAgent, err error) {
+	ctx, span := tracing.Start(ctx, "consul.dev-agent")
+	defer func() { tracing.End(span, err) }()
+
+	ports, err := freePorts(3)
+	if err != nil {
+		return nil, fmt.Errorf("error finding free ports: %v", err)
+	}
+	hcl := fmt.Sprintf("ports { http = %d, server = %d, serf_lan = %d, serf_wan = -1, dns = -1, grpc = -1, grpc_tls = -1 }", ports[0], ports[1], ports[2])
+
+	a := &DevAgent{
+		URL:    fmt.Sprintf("http://127.0.0.1:%d", ports[0]),
+		output: &tailWriter{n: devAgentOutputLimit},
+		exited: make(chan struct{}),
+	}
+	a.cmd = exec.Command(binary, "agent", "-dev", "-bind", "127.0.0.1", "-client", "127.0.0.1", "-node", DevNodeName, "-log-level", "warn", "-hcl", hcl)
+	a.cmd.Stdout = a.output
+	a.cmd.Stderr = a.output
+	if err := a.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting %s: %v", binary, err)
+	}
+	go func() {
+		a.err = a.cmd.Wait()
+		close(a.exited)
+	}()
+	stop := context.AfterFunc(ctx, func() { a.cmd.Process.Kill() })
+	defer func() {
+		if err != nil {
+			stop()
+			a.Stop()
+		}
+	}()
+
+	client, err := api.NewClient(&api.Config{Address: a.URL})
+	if err != nil {
+		return nil, err
+	}
+	tick := time.NewTicker(250 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		leader, err := client.Status().LeaderWithQueryOptions((&api.QueryOptions{}).WithContext(ctx))
+		if err == nil && leader != "" {
+			return a, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("the dev agent did not elect a leader: %v", ctx.Err())
+		case <-a.exited:
+			return nil, fmt.Errorf("the dev agent exited: %v: %s", a.err, a.Output())
+		case <-tick.C:
+		}
+	}
+}
+
+// Stop asks the agent to leave, and kills it if it is still running after a while
+func (a *DevAgent) Stop() error {
+	select {
+	case <-a.exited:
+		return nil
+	default:
+	}
+	a.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-a.exited:
+		return nil
+	case <-time.After(devAgentStopTimeout):
+		a.cmd.Process.Kill()
+		<-a.exited
+		return errors.New("the dev agent did not stop in time, and was killed")
+	}
+}
+
+// Output returns the end of the output of the agent
+func (a *DevAgent) Output() string {
+	return strings.TrimSpace(a.output.String())
+}
+
+// freePorts returns n local TCP ports that are free, at least for now
+func freePorts(n int) ([]int, error) {
+	var ports []int
+	for range n {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
+
+// tailWriter keeps the last n bytes written to it
+type tailWriter struct {
+	mu  sync.Mutex
+	n   int
+	buf []byte
+}
+
+func (tw *tailWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.buf = append(tw.buf, p...)
+	if len(tw.buf) > tw.n {
+		tw.buf = tw.buf[len(tw.buf)-tw.n:]
+	}
+	return len(p), nil
+}
+
+func (tw *tailWriter) String() string {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return string(tw.buf)
+}
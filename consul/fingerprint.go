@@ -0,0 +1,120 @@
+package consul
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/hashicorp/consul/snapshot"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-msgpack/v2/codec"
+)
+
+// types of the messages in the state of a snapshot (see MessageType in github.com/hashicorp/consul/agent/structs)
+const (
+	registerMessage    = 0
+	kvsMessage         = 2
+	sessionMessage     = 3
+	tombstoneMessage   = 5
+	coordinatesMessage = 6
+	indexMessage       = 16
+	chunkingMessage    = 29
+)
+
+// volatileMessages change without the cluster changing: with every lock the snapshotter takes, or on their own
+var volatileMessages = map[byte]bool{
+	sessionMessage:     true,
+	tombstoneMessage:   true,
+	coordinatesMessage: true,
+	indexMessage:       true,
+	chunkingMessage:    true,
+}
+
+// Fingerprint hashes the state held by the snapshot file, leaving out the volatile messages and the given KV keys,
+// so that two snapshots of a cluster that did not change get the same fingerprint
+func Fingerprint(file string, ignoreKeys ...string) (string, error) {
+	ignore := map[string]bool{}
+	for _, key := range ignoreKeys {
+		ignore[key] = true
+	}
+
+	hash := sha256.New()
+	enc := codec.NewEncoder(hash, newMsgpackHandle())
+
+	err := eachMessage(file, func(msgType byte, msg interface{}) error {
+		if volatileMessages[msgType] {
+			return nil
+		}
+		if entry, ok := msg.(map[string]interface{}); ok && msgType == kvsMessage && ignore[fmt.Sprint(entry["Key"])] {
+			return nil
+		}
+
+		hash.Write([]byte{msgType})
+		return enc.Encode(msg)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// newMsgpackHandle returns the handle the messages of a snapshot are decoded, and fingerprinted, with
+func newMsgpackHandle() *codec.MsgpackHandle {
+	handle := &codec.MsgpackHandle{}
+	handle.RawToString = true
+	handle.MapType = reflect.TypeOf(map[string]interface{}{})
+	// sort the map keys, so that the same state is always encoded the same
+	handle.Canonical = true
+	return handle
+}
+
+// eachMessage decodes the state held by the snapshot file, and calls fn with every message in it, in order,
+// until fn returns an error
+func eachMessage(file string, fn func(msgType byte, msg interface{}) error) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	state, _, err := snapshot.Read(hclog.NewNullLogger(), in)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %v", err)
+	}
+	defer func() {
+		state.Close()
+		os.Remove(state.Name())
+	}()
+
+	r := bufio.NewReader(state)
+	dec := codec.NewDecoder(r, newMsgpackHandle())
+
+	// the header only holds the last index
+	var header interface{}
+	if err := dec.Decode(&header); err != nil {
+		return fmt.Errorf("error decoding snapshot header: %v", err)
+	}
+
+	for {
+		msgType, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg interface{}
+		if err := dec.Decode(&msg); err != nil {
+			return fmt.Errorf("error decoding snapshot message of type %d: %v", msgType, err)
+		}
+		if err := fn(msgType, msg); err != nil {
+			return err
+		}
+	}
+}
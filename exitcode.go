@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// process exit codes
+const (
+	exitOK                     = 0
+	exitError                  = 1
+	exitInvalidConfig          = 2
+	exitLockBusy               = 3
+	exitSnapshotFailed         = 4
+	exitRequiredOutputFailed   = 5
+	exitBestEffortOutputFailed = 6
+	exitRetentionFailed        = 7
+	exitHookFailed             = 8
+	exitSanityCheckFailed      = 9
+	exitRestoreFailed          = 10
+)
+
+// runError is the error of a backup run, with the exit code a single execution ends with because of it
+type runError struct {
+	code int
+	err  error
+}
+
+func (e *runError) Error() string {
+	return e.err.Error()
+}
+
+func (e *runError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the exit code of a single execution that ended with err
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	var runErr *runError
+	if errors.As(err, &runErr) {
+		return runErr.code
+	}
+	return exitError
+}
+
+// runResults names the outcome of a backup run, after the exit code it ends with, in the metrics
+var runResults = map[int]string{
+	exitOK:                     "ok",
+	exitLockBusy:               "lock-busy",
+	exitSnapshotFailed:         "snapshot-failed",
+	exitRequiredOutputFailed:   "required-output-failed",
+	exitBestEffortOutputFailed: "best-effort-output-failed",
+	exitRetentionFailed:        "retention-failed",
+	exitHookFailed:             "hook-failed",
+	exitSanityCheckFailed:      "sanity-check-failed",
+	exitRestoreFailed:          "restore-failed",
+}
+
+// runResult returns the name of the outcome of a backup run that ended with err
+func runResult(err error) string {
+	if result, ok := runResults[exitCode(err)]; ok {
+		return result
+	}
+	return "error"
+}
+
+// signalExitCode follows the shell convention of 128+n for a process terminated by signal n
+func signalExitCode(s os.Signal) int {
+	if sig, ok := s.(syscall.Signal); ok {
+		return 128 + int(sig)
+	}
+	return exitError
+}
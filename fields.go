@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// redacted replaces the value of secret settings wherever the config is displayed
+const redacted = "<redacted>"
+
+// configField is a single setting, keyed as in the config file (e.g. "consul.token")
+type configField struct {
+	Key    string
+	Value  string
+	Secret bool
+}
+
+// DisplayValue returns the value of the setting, redacted if it is a secret
+func (f configField) DisplayValue() string {
+	if f.Secret && f.Value != "" {
+		return redacted
+	}
+	return f.Value
+}
+
+// configFields flattens c into its settings, sorted by key.
+// Struct fields are named after their json tag, and the ones tagged `secret:"true"` are flagged as secrets.
+func configFields(c *config) []configField {
+	var fields []configField
+	flattenFields("", reflect.ValueOf(*c), false, &fields)
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Key < fields[j].Key })
+	return fields
+}
+
+func flattenFields(key string, v reflect.Value, secret bool, fields *[]configField) {
+	switch {
+	case v.Kind() == reflect.Pointer:
+		if !v.IsNil() {
+			flattenFields(key, v.Elem(), secret, fields)
+		}
+	case v.Kind() == reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, inline := jsonName(t.Field(i))
+			if name == "" {
+				continue
+			}
+			fieldKey := joinKey(key, name)
+			if inline {
+				fieldKey = key
+			}
+			flattenFields(fieldKey, v.Field(i), t.Field(i).Tag.Get("secret") == "true", fields)
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		for i := 0; i < v.Len(); i++ {
+			flattenFields(joinKey(key, fmt.Sprint(i)), v.Index(i), secret, fields)
+		}
+	default:
+		*fields = append(*fields, configField{Key: key, Value: formatValue(v), Secret: secret})
+	}
+}
+
+// jsonName returns the name of a struct field in the config, or "" if it has none.
+// Inlined fields (`json:"name,inline"`) have their own fields flattened into the parent struct.
+func jsonName(f reflect.StructField) (name string, inline bool) {
+	name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" {
+		return "", false
+	}
+	return name, opts == "inline"
+}
+
+func formatValue(v reflect.Value) string {
+	switch val := v.Interface().(type) {
+	case time.Duration:
+		return val.String()
+	case []string:
+		return strings.Join(val, ",")
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func joinKey(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+// diffConfig lists the settings that differ between old and new, with secrets redacted
+func diffConfig(old, new *config) []string {
+	oldFields := map[string]configField{}
+	for _, f := range configFields(old) {
+		oldFields[f.Key] = f
+	}
+	newFields := map[string]configField{}
+	for _, f := range configFields(new) {
+		newFields[f.Key] = f
+	}
+
+	keys := []string{}
+	for k := range oldFields {
+		keys = append(keys, k)
+	}
+	for k := range newFields {
+		if _, ok := oldFields[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, k := range keys {
+		o, n := oldFields[k], newFields[k]
+		if o.Value == n.Value {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %q -> %q", k, o.DisplayValue(), n.DisplayValue()))
+	}
+	return changes
+}
+
+// the places a setting can be read from, by order of precedence
+const (
+	sourceFlag    = "flag"
+	sourceEnv     = "env"
+	sourceFile    = "file"
+	sourceDefault = "default"
+)
+
+// settingSources finds where each setting of c was read from by v, keyed as in configFields.
+// Settings nested in a list (e.g. "outputs.0.name") take the source of the list itself.
+func settingSources(v *viper.Viper, c *config) map[string]string {
+	sources := map[string]string{}
+	for _, f := range configFields(c) {
+		source := settingSource(v, f.Key)
+		if source == "" {
+			if list := listKey(f.Key); list != "" {
+				source = settingSource(v, list)
+			}
+		}
+		if source == "" {
+			source = sourceDefault
+		}
+		sources[f.Key] = source
+	}
+	return sources
+}
+
+// settingSource returns where v read key from, or "" if it used the default value
+func settingSource(v *viper.Viper, key string) string {
+	if flag := pflag.Lookup(key); flag != nil && flag.Changed {
+		return sourceFlag + " --" + key
+	}
+	for _, b := range envBindings {
+		if b.key == key {
+			if _, ok := os.LookupEnv(b.env); ok {
+				return sourceEnv + " " + b.env
+			}
+		}
+	}
+	if v.InConfig(key) {
+		return sourceFile
+	}
+	return ""
+}
+
+// listKey returns the key of the list that key is nested in (e.g. "outputs" for "outputs.0.name"), or ""
+func listKey(key string) string {
+	segments := strings.Split(key, ".")
+	for i, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil && i > 0 {
+			return strings.Join(segments[:i], ".")
+		}
+	}
+	return ""
+}
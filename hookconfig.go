@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// the events hooks run on
+const (
+	hookPreSnapshot  = "pre-snapshot"
+	hookPostSnapshot = "post-snapshot"
+	hookPostOutput   = "post-output"
+	hookOnFailure    = "on-failure"
+)
+
+var hookEvents = []string{hookPreSnapshot, hookPostSnapshot, hookPostOutput, hookOnFailure}
+
+type hooksConfig struct {
+	// Timeout is the timeout of the hooks that do not set their own
+	Timeout      time.Duration `json:"timeout"`
+	PreSnapshot  []hookConfig  `json:"pre-snapshot"`
+	PostSnapshot []hookConfig  `json:"post-snapshot"`
+	PostOutput   []hookConfig  `json:"post-output"`
+	OnFailure    []hookConfig  `json:"on-failure"`
+}
+
+// hookConfig is a command run on an event of the backup runs
+type hookConfig struct {
+	Name string `json:"name"`
+	// Command is the command line to run, directly and not through a shell
+	Command []string      `json:"command"`
+	Timeout time.Duration `json:"timeout"`
+	// AbortOnFailure aborts the run when a pre-snapshot hook fails
+	AbortOnFailure bool `json:"abort-on-failure"`
+
+	// settings of the hook that it does not have
+	unknownKeys []string
+	// settings of the hook that could not be read
+	invalidSettings []error
+}
+
+// hooks returns the hooks of event
+func (hc *hooksConfig) hooks(event string) *[]hookConfig {
+	switch event {
+	case hookPreSnapshot:
+		return &hc.PreSnapshot
+	case hookPostSnapshot:
+		return &hc.PostSnapshot
+	case hookPostOutput:
+		return &hc.PostOutput
+	case hookOnFailure:
+		return &hc.OnFailure
+	}
+	panic("unknown hook event " + event)
+}
+
+// readHooksConfig reads the hooks of every event, each one a command line or a hook with its own settings:
+//
+//	hooks:
+//	  pre-snapshot:
+//	    - /usr/local/bin/pause-deploys
+//	    - name: check-window
+//	      command: [/usr/local/bin/check-window, --max-age, 1h]
+//	      timeout: 30s
+func readHooksConfig(v *viper.Viper) (hooksConfig, error) {
+	hc := hooksConfig{Timeout: v.GetDuration("hooks.timeout")}
+
+	for _, event := range hookEvents {
+		key := "hooks." + event
+		var entries []interface{}
+		switch hooks := v.Get(key).(type) {
+		case []interface{}:
+			entries = hooks
+		case nil:
+		default:
+			return hc, fmt.Errorf("%s: expected a list, got %T", key, hooks)
+		}
+
+		var hooks []hookConfig
+		for i, entry := range entries {
+			switch entry := entry.(type) {
+			case string:
+				hooks = append(hooks, newHookConfig(event, map[string]interface{}{"command": entry}))
+			case map[string]interface{}:
+				hooks = append(hooks, newHookConfig(event, entry))
+			default:
+				return hc, fmt.Errorf("%s.%d: expected a command or a hook with a command, got %T", key, i, entry)
+			}
+		}
+		*hc.hooks(event) = hooks
+	}
+	return hc, nil
+}
+
+func newHookConfig(event string, settings map[string]interface{}) hookConfig {
+	iv := viper.New()
+	// pre-snapshot hooks abort the run by default
+	iv.SetDefault("abort-on-failure", event == hookPreSnapshot)
+	iv.MergeConfigMap(settings)
+
+	h := hookConfig{
+		Name:           iv.GetString("name"),
+		AbortOnFailure: iv.GetBool("abort-on-failure"),
+	}
+	if command, ok := settings["command"]; ok {
+		var err error
+		// a command line is split on spaces
+		if h.Command, err = cast.ToStringSliceE(command); err != nil {
+			h.invalidSettings = append(h.invalidSettings, fmt.Errorf("command: expected a command line or a list, got %q", fmt.Sprint(command)))
+		}
+	}
+	if timeout, ok := settings["timeout"]; ok {
+		var err error
+		if h.Timeout, err = cast.ToDurationE(timeout); err != nil {
+			h.invalidSettings = append(h.invalidSettings, fmt.Errorf("timeout: expected a duration, got %q", fmt.Sprint(timeout)))
+		}
+	}
+	if h.Name == "" && len(h.Command) > 0 {
+		h.Name = h.Command[0]
+	}
+
+	for key := range settings {
+		if !hasJSONField(reflect.TypeOf(h), key) {
+			h.unknownKeys = append(h.unknownKeys, key)
+		}
+	}
+	sort.Strings(h.unknownKeys)
+
+	return h
+}
+
+// validate lists the problems of the hook, run on event, through problem
+func (h *hookConfig) validate(key, event string, problem func(format string, a ...interface{})) {
+	for _, k := range h.unknownKeys {
+		problem("%s: unknown setting %q", key, k)
+	}
+	for _, err := range h.invalidSettings {
+		problem("%s: %v", key, err)
+	}
+	if len(h.Command) == 0 || h.Command[0] == "" {
+		problem("%s: command must be set", key)
+	}
+	if h.Timeout < 0 {
+		problem("%s: timeout must not be negative", key)
+	}
+	if h.AbortOnFailure && event != hookPreSnapshot {
+		problem("%s: abort-on-failure is only used by %s hooks", key, hookPreSnapshot)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/ruizink/consul-snapshotter/consul"
+	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/tracing"
+)
+
+// hookEnvPrefix prefixes the env vars describing the run to the hooks
+const hookEnvPrefix = "CONSUL_SNAPSHOTTER_"
+
+// hookWaitDelay bounds the wait for the output of a hook that was killed, e.g. held by its children
+const hookWaitDelay = 5 * time.Second
+
+// hookOutputLimit bounds the output of a hook kept for the log
+const hookOutputLimit = 4096
+
+// hookEnv describes a run to its hooks, as env vars without their prefix
+type hookEnv map[string]string
+
+// newHookEnv describes the run, of the cluster
+func newHookEnv(run *backupRun, cluster string) hookEnv {
+	return hookEnv{
+		"RUN_ID":  run.ID,
+		"TRIGGER": run.Trigger,
+		"CLUSTER": cluster,
+	}
+}
+
+// with returns a copy of env with the given variables, as alternating names and values, added
+func (env hookEnv) with(namesAndValues ...string) hookEnv {
+	vars := hookEnv{}
+	for k, v := range env {
+		vars[k] = v
+	}
+	for i := 0; i+1 < len(namesAndValues); i += 2 {
+		vars[namesAndValues[i]] = namesAndValues[i+1]
+	}
+	return vars
+}
+
+// withSnapshot adds the snapshot, and its path if it is still there
+func (env hookEnv) withSnapshot(snap *consul.Snapshot, withPath bool) hookEnv {
+	if snap == nil {
+		return env
+	}
+	env = env.with(
+		"SNAPSHOT_INDEX", strconv.FormatUint(snap.LastIndex, 10),
+		"SNAPSHOT_SIZE", strconv.FormatInt(snap.Size, 10),
+	)
+	if withPath {
+		env = env.with("SNAPSHOT_PATH", snap.File)
+	}
+	return env
+}
+
+// withOutput adds the result r of an output, which saved the snapshot as filename
+func (env hookEnv) withOutput(r outputResult, filename string) hookEnv {
+	var errMsg string
+	if err := r.err(); err != nil {
+		errMsg = err.Error()
+	}
+	return env.with(
+		"OUTPUT_NAME", r.Name,
+		"OUTPUT_TYPE", r.Type,
+		"OUTPUT_FILENAME", filename,
+		"OUTPUT_STATUS", r.status(),
+		"OUTPUT_BYTES", strconv.FormatInt(r.Bytes, 10),
+		"OUTPUT_DELETED", strconv.Itoa(r.Deleted),
+		"OUTPUT_ERROR", errMsg,
+	)
+}
+
+// withResult adds the result of the run, which ended with err, and of all its outputs, as JSON
+func (env hookEnv) withResult(results []outputResult, err error) hookEnv {
+	var errMsg string
+	if err != nil {
+		errMsg = strings.TrimSpace(err.Error())
+	}
+	records := make(map[string]outputRecord, len(results))
+	now := time.Now().UTC()
+	for _, r := range results {
+		records[r.Name] = newOutputRecord(r, now)
+	}
+	outputs, _ := json.Marshal(records)
+	return env.with(
+		"RESULT", runResult(err),
+		"ERROR", errMsg,
+		"OUTPUTS", string(outputs),
+	)
+}
+
+// environ returns the env of a hook run on event: the one of the process, and env
+func (env hookEnv) environ(event string) []string {
+	vars := append(os.Environ(), hookEnvPrefix+"HOOK="+event)
+	for k, v := range env {
+		vars = append(vars, hookEnvPrefix+k+"="+v)
+	}
+	return vars
+}
+
+// runHooks runs the hooks of event one after the other, with env.
+// It returns the error of the first failed hook set to abort the run, and only logs the others.
+func runHooks(ctx context.Context, c *config, event string, env hookEnv) error {
+	for _, h := range *c.Hooks.hooks(event) {
+		timeout := h.Timeout
+		if timeout == 0 {
+			timeout = c.Hooks.Timeout
+		}
+		err := runHook(ctx, h, event, env, timeout)
+		if err == nil {
+			continue
+		}
+		if h.AbortOnFailure {
+			return fmt.Errorf("%s hook %s failed: %v", event, h.Name, err)
+		}
+	}
+	return nil
+}
+
+// runHook runs the hook h of event with env, killing it after timeout
+func runHook(ctx context.Context, h hookConfig, event string, env hookEnv, timeout time.Duration) (err error) {
+	log := logger.FromContext(ctx).With("hook", h.Name, "event", event)
+	ctx, span := tracing.Start(ctx, "hook", attribute.String("hook.event", event), attribute.String("hook.name", h.Name))
+	defer func() { tracing.End(span, err) }()
+
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = env.environ(event)
+	cmd.Stdout = &limitedWriter{w: &output, n: hookOutputLimit}
+	cmd.Stderr = cmd.Stdout
+	cmd.WaitDelay = hookWaitDelay
+
+	log.Info(fmt.Sprintf("Running %s hook: %s", event, h.Name))
+	start := time.Now()
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+
+	l := log.With("duration", time.Since(start).Round(time.Millisecond).String())
+	if msg := strings.TrimSpace(output.String()); msg != "" {
+		l = l.With("hook_output", msg)
+	}
+	if err != nil {
+		l.Error("Hook failed: ", err)
+		return err
+	}
+	l.Info("Hook done")
+	return nil
+}
+
+// limitedWriter writes up to n bytes to w, and discards the rest
+type limitedWriter struct {
+	w *bytes.Buffer
+	n int
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if room := lw.n - lw.w.Len(); room > 0 {
+		lw.w.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
@@ -1,38 +1,136 @@
 package logger
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+// log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
 var (
-	log *logrus.Logger
+	log  *logrus.Logger
+	root *Logger
 )
 
 func init() {
 	log = logrus.New()
 	log.SetOutput(os.Stdout)
-	log.SetFormatter(&logrus.TextFormatter{TimestampFormat: "2006-01-02 15:04:05", FullTimestamp: true})
+	SetFormat(FormatText)
+	root = &Logger{entry: logrus.NewEntry(log)}
+}
+
+// Logger logs lines carrying a set of fields (e.g. the run ID)
+type Logger struct {
+	entry *logrus.Entry
+}
+
+// With returns a logger adding the given fields, as alternating keys and values, to every line
+func With(keysAndValues ...interface{}) *Logger {
+	return root.With(keysAndValues...)
+}
+
+// With returns a logger adding the given fields, as alternating keys and values, to the ones of l
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := logrus.Fields{}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		if i+1 == len(keysAndValues) {
+			fields[key] = "(missing)"
+			break
+		}
+		fields[key] = keysAndValues[i+1]
+	}
+	return &Logger{entry: l.entry.WithFields(fields)}
+}
+
+func (l *Logger) Info(v ...interface{}) {
+	l.entry.Info(v...)
+}
+
+func (l *Logger) Warn(v ...interface{}) {
+	l.entry.Warn(v...)
+}
+
+func (l *Logger) Error(v ...interface{}) {
+	l.entry.Error(v...)
+}
+
+func (l *Logger) Debug(v ...interface{}) {
+	l.entry.Debug(v...)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or one without fields if there is none
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return root
 }
 
 func Info(v ...interface{}) {
-	log.Info(v...)
+	root.Info(v...)
 }
 
 func Warn(v ...interface{}) {
-	log.Warn(v...)
+	root.Warn(v...)
 }
 
 func Error(v ...interface{}) {
-	log.Error(v...)
+	root.Error(v...)
 }
 
 func Debug(v ...interface{}) {
-	log.Debug(v...)
+	root.Debug(v...)
 }
 
-func SetLevel(level string) {
-	l, _ := logrus.ParseLevel(level)
+func SetLevel(level string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
 	log.SetLevel(l)
+	return nil
+}
+
+// CheckLevel returns an error if level is not a valid log level
+func CheckLevel(level string) error {
+	_, err := logrus.ParseLevel(level)
+	return err
+}
+
+// SetFormat sets the format of the lines: text (logfmt-style key=value pairs) or json (one object per line)
+func SetFormat(format string) error {
+	switch format {
+	case FormatText:
+		log.SetFormatter(&logrus.TextFormatter{TimestampFormat: "2006-01-02 15:04:05", FullTimestamp: true})
+	case FormatJSON:
+		log.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano, DisableHTMLEscape: true})
+	default:
+		return CheckFormat(format)
+	}
+	return nil
+}
+
+// CheckFormat returns an error if format is not a valid log format
+func CheckFormat(format string) error {
+	switch format {
+	case FormatText, FormatJSON:
+		return nil
+	}
+	return fmt.Errorf("invalid log format %q (must be %s or %s)", format, FormatText, FormatJSON)
 }
@@ -2,200 +2,616 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/hashicorp/go-multierror"
-	"github.com/robfig/cron"
+	"github.com/spf13/pflag"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/ruizink/consul-snapshotter/azure"
 	"github.com/ruizink/consul-snapshotter/consul"
 	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/metrics"
+	"github.com/ruizink/consul-snapshotter/naming"
 	"github.com/ruizink/consul-snapshotter/outputs"
+	"github.com/ruizink/consul-snapshotter/throttle"
+	"github.com/ruizink/consul-snapshotter/tracing"
+	"github.com/ruizink/consul-snapshotter/version"
 )
 
+// flushTracesTimeout bounds the export of the last traces, on exit
+const flushTracesTimeout = 5 * time.Second
+
+// releaseLockTimeout bounds the lock cleanup, which runs even after the run was cancelled
+const releaseLockTimeout = 10 * time.Second
+
 func main() {
-	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
+	parseFlags()
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt, syscall.SIGHUP)
+	if args := pflag.Args(); len(args) > 0 {
+		os.Exit(runCommand(args))
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		logConfigError("Could not load config:", err)
+		os.Exit(exitInvalidConfig)
+	}
+	if err := c.validate(); err != nil {
+		logConfigError("Invalid config:", err)
+		os.Exit(exitInvalidConfig)
+	}
+	logger.SetLevel(c.LogLevel)
+	logger.SetFormat(c.LogFormat)
+
+	flushTraces := func() {}
+	if c.Tracing.Enabled {
+		shutdown, err := tracing.Setup(context.Background(), tracing.Config{
+			Endpoint:    c.Tracing.Endpoint,
+			ServiceName: c.Tracing.ServiceName,
+			Version:     version.Version,
+			SampleRatio: c.Tracing.SampleRatio,
+		})
+		if err != nil {
+			logger.Error("Could not set up tracing: ", err)
+			os.Exit(exitError)
+		}
+		flushTraces = func() {
+			ctx, cancel := context.WithTimeout(context.Background(), flushTracesTimeout)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				logger.Warn("Could not export the last traces: ", err)
+			}
+		}
+	}
+
+	s := newSnapshotter(c)
 
-	c := &config{}
+	// runCtx is cancelled to abort in-flight backups, while stopCtx
+	// only asks the scheduler to stop and let them finish
+	runCtx, abort := context.WithCancel(context.Background())
+	stopCtx, stop := context.WithCancel(context.Background())
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	defer func() {
 		signal.Stop(signalChan)
-		cancel()
+		abort()
 	}()
 
+	var (
+		shutdownSignal os.Signal
+		forced         atomic.Bool
+	)
+
 	go func() {
-		for {
-			select {
-			case s := <-signalChan:
-				switch s {
-				case syscall.SIGHUP:
-					logger.Info("Caught SIGHUP. Triggering a config reload.")
-					c.loadConfig()
-				case os.Interrupt:
-					cancel()
-					os.Exit(1)
+		for sig := range signalChan {
+			switch sig {
+			case syscall.SIGHUP:
+				logger.Info("Caught SIGHUP. Triggering a config reload.")
+				if err := s.reload(); err != nil {
+					logConfigError("Could not reload config, keeping the current one:", err)
 				}
-			case <-ctx.Done():
-				// logger.Info("Terminated.")
-				os.Exit(0)
+			case os.Interrupt, syscall.SIGTERM:
+				if shutdownSignal != nil {
+					logger.Warn("Caught ", sig, " again. Cancelling in-flight backup...")
+					forced.Store(true)
+					abort()
+					continue
+				}
+				shutdownSignal = sig
+				gracePeriod := s.currentConfig().ShutdownGracePeriod
+				logger.Info(fmt.Sprintf("Caught %v. Shutting down (grace period: %v)...", sig, gracePeriod))
+				stop()
+				time.AfterFunc(gracePeriod, func() {
+					logger.Warn("Shutdown grace period expired. Cancelling in-flight backup...")
+					forced.Store(true)
+					abort()
+				})
 			}
 		}
 	}()
 
-	if err := run(ctx, c, os.Stdout); err != nil {
-		// fmt.Fprintf(os.Stderr, "%s\n", err)
-		os.Exit(1)
+	if c.WatchConfig {
+		if err := s.watchConfig(stopCtx, c.ConfigDir, c.WatchDebounce); err != nil {
+			logger.Error("Could not watch the config file: ", err)
+			os.Exit(exitError)
+		}
 	}
+
+	if c.HTTP.Address != "" {
+		if err := startHTTPServer(runCtx, c.HTTP.Address, s); err != nil {
+			logger.Error("Could not start the HTTP server: ", err)
+			os.Exit(exitError)
+		}
+	}
+
+	err = s.run(runCtx, stopCtx)
+	flushTraces()
+	if forced.Load() {
+		os.Exit(signalExitCode(shutdownSignal))
+	}
+	os.Exit(exitCode(err))
 }
 
-func run(ctx context.Context, c *config, stdout io.Writer) error {
-	c.loadConfig()
-	logger.SetLevel(c.LogLevel)
+// backup performs a single snapshot backup procedure, using the config in use when it starts,
+// and records its progress in run
+func (s *snapshotter) backup(ctx context.Context, run *backupRun) (err error) {
+	c := s.currentConfig()
+	start := time.Now()
+	// the cluster the metrics are labelled with, set once the agent info is read
+	cluster := ""
+	var (
+		snap    *consul.Snapshot
+		results []outputResult
+	)
+	defer func() {
+		result := runResult(err)
+		metrics.Runs.WithLabelValues(cluster, result).Inc()
+		metrics.RunDuration.WithLabelValues(cluster, result).Observe(time.Since(start).Seconds())
+		recovered := s.status.recordRun(start, results, err)
+		s.digest.recordRun(cluster, results, err)
+		if err != nil && exitCode(err) != exitLockBusy {
+			// the snapshot file is removed already
+			env := newHookEnv(run, cluster).withSnapshot(snap, false).withResult(results, err)
+			runHooks(context.WithoutCancel(ctx), c, hookOnFailure, env)
+		}
+		s.notifyRun(ctx, c, run, cluster, start, snap, results, err, recovered)
+	}()
 
-	runSnapshotter := func() error {
-		logger.Info("####################################################################################")
-		logger.Info("===> Performing Consul snapshot backup procedure...")
-		defer logger.Info("####################################################################################")
-		// create new consul client
-		consulWorker, err := consul.NewConsul(c.ConsulConfig.URL, c.ConsulConfig.Token, c.ConsulConfig.LockKey, c.ConsulConfig.LockTimeout)
-		if err != nil {
-			logger.Error("Could not create a consul client: ", err)
-			return err
+	// the span of the run ends before the notifications are sent
+	ctx, span := tracing.Start(ctx, "backup", attribute.String("run.id", run.ID), attribute.String("run.trigger", run.Trigger))
+	defer func() {
+		span.SetAttributes(tracing.AttrCluster.String(cluster), attribute.String("run.result", runResult(err)))
+		tracing.End(span, err)
+	}()
+
+	// every line of the run carries its ID, then the cluster and the session once they are known
+	log := logger.With("run_id", run.ID, "trigger", run.Trigger)
+	if id := tracing.TraceID(ctx); id != "" {
+		log = log.With("trace_id", id)
+	}
+	ctx = logger.NewContext(ctx, log)
+
+	log.Info("####################################################################################")
+	log.Info("===> Performing Consul snapshot backup procedure...")
+	defer func() {
+		log.Info("####################################################################################")
+	}()
+	// create new consul client
+	consulWorker, err := consul.NewConsul(c.ConsulConfig.URL, c.ConsulConfig.Token, c.ConsulConfig.LockKey, c.ConsulConfig.LockTimeout)
+	if err != nil {
+		log.Error("Could not create a consul client: ", err)
+		return &runError{exitSnapshotFailed, err}
+	}
+
+	tmpl, err := naming.New(c.FilenameTemplate)
+	if err != nil {
+		log.Error("Invalid filename template: ", err)
+		return &runError{exitError, err}
+	}
+	outs, err := selectOutputs(c.Outputs, run.Outputs)
+	if err != nil {
+		log.Error("Could not select the outputs: ", err)
+		return &runError{exitError, err}
+	}
+
+	// read the datacenter, which labels the metrics, and may be part of the snapshot file names
+	agentCtx, cancelAgent := withTimeout(ctx, c.Timeouts.Snapshot)
+	agent, err := consulWorker.GetAgentInfo(agentCtx)
+	cancelAgent()
+	if err != nil {
+		if tmpl.Uses("Datacenter") || tmpl.Uses("NodeName") {
+			log.Error("Could not read the agent info: ", err)
+			return &runError{exitSnapshotFailed, err}
 		}
+		log.Warn("Could not read the agent info: ", err)
+		agent = &consul.AgentInfo{}
+	}
+	cluster = agent.Datacenter
+	log = log.With("cluster", cluster)
+	ctx = logger.NewContext(ctx, log)
 
-		// acquire lock
-		if err := consulWorker.AcquireLock(); err != nil {
-			logger.Error("Could not acquire lock: ", err)
-			return err
+	// acquire lock
+	run.setStep("lock")
+	if err := consulWorker.AcquireLock(ctx); err != nil {
+		log.Error("Could not acquire lock: ", err)
+		if errors.Is(err, consul.ErrLockBusy) {
+			metrics.LockFailures.WithLabelValues(cluster, "busy").Inc()
+			return &runError{exitLockBusy, err}
 		}
-		logger.Debug("Acquired lock for session ID: ", consulWorker.SessionID)
+		metrics.LockFailures.WithLabelValues(cluster, "error").Inc()
+		return &runError{exitSnapshotFailed, err}
+	}
+	log = log.With("session_id", consulWorker.SessionID)
+	ctx = logger.NewContext(ctx, log)
+	log.Debug("Acquired lock")
 
-		// Cleanup: Release the lock
-		defer func() {
-			if err := consulWorker.ReleaseLock(); err != nil {
-				logger.Error("Could not release lock: ", err)
-			}
-			logger.Debug("Released lock for session ID: ", consulWorker.SessionID)
-		}()
+	// Cleanup: Release the lock, even if ctx was cancelled meanwhile
+	defer func() {
+		releaseCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseLockTimeout)
+		defer cancel()
+		if err := consulWorker.ReleaseLock(releaseCtx); err != nil {
+			log.Error("Could not release lock: ", err)
+			return
+		}
+		log.Debug("Released lock")
+	}()
 
-		// Start renewing the session until doneChan is closed
-		doneChan := make(chan struct{})
-		go consulWorker.RenewSession(doneChan)
+	// Start renewing the session until renewCtx is done
+	renewCtx, stopRenew := context.WithCancel(ctx)
+	go consulWorker.RenewSession(renewCtx)
 
-		// Cleanup: Close the channel used for session renewal
-		defer close(doneChan)
+	// Cleanup: Stop the session renewal
+	defer stopRenew()
 
-		// Get consul snapshot
-		snap, err := consulWorker.GetSnapshot()
-		if err != nil {
-			logger.Error("Could not perform snapshot: ", err)
-			return err
-		}
+	// Run the pre-snapshot hooks, which may abort the run
+	env := newHookEnv(run, cluster)
+	if err := runHooks(ctx, c, hookPreSnapshot, env); err != nil {
+		log.Error("Aborting the backup: ", err)
+		return &runError{exitHookFailed, err}
+	}
 
-		// Cleanup: Remove the temporary snapshot
-		defer os.Remove(snap)
+	// Get consul snapshot
+	run.setStep("snapshot")
+	snapCtx, cancelSnap := withTimeout(ctx, c.Timeouts.Snapshot)
+	snap, err = consulWorker.GetSnapshot(snapCtx)
+	cancelSnap()
+	if err != nil {
+		log.Error("Could not perform snapshot: ", err)
+		return &runError{exitSnapshotFailed, err}
+	}
+
+	// Cleanup: Remove the temporary snapshot
+	defer os.Remove(snap.File)
+
+	metrics.SnapshotSize.WithLabelValues(cluster).Set(float64(snap.Size))
+	metrics.SnapshotIndex.WithLabelValues(cluster).Set(float64(snap.LastIndex))
+
+	env = env.withSnapshot(snap, true)
+	runHooks(ctx, c, hookPostSnapshot, env)
 
-		// Export the snapshot to all the configured outputs
-		if err := processOutputs(snap, c); err != nil {
-			return err
+	// Gather the values the snapshot file names are made of
+	hostname, _ := os.Hostname()
+	data := naming.Data{
+		Datacenter: agent.Datacenter,
+		NodeName:   agent.NodeName,
+		Hostname:   hostname,
+		RunID:      run.ID,
+		Prefix:     c.FilenamePrefix,
+		Extension:  c.FileExtension,
+		LastIndex:  snap.LastIndex,
+		Time:       time.Now().UTC(),
+	}
+
+	// Read the last uploaded snapshots, and the last one that passed the sanity checks
+	var state *backupState
+	if c.keepsState() {
+		stateCtx, cancel := withTimeout(ctx, c.Timeouts.Snapshot)
+		var stateErr error
+		state, stateErr = readBackupState(stateCtx, consulWorker, c.ConsulConfig.StateKey)
+		cancel()
+		if stateErr != nil {
+			log.Warn("Could not read the state of the last backups, uploading the snapshot to every output and leaving the state as it is: ", stateErr)
 		}
+	}
 
-		return nil
+	// Check the snapshot holds what it should, or keep the older snapshots around
+	run.setStep("checks")
+	checksErr := checkSanity(ctx, snap, state, tmpl, outs, cluster, c)
+	if checksErr != nil {
+		log.Error("The snapshot failed the sanity checks, not applying the retention policies: ", checksErr)
 	}
 
-	runSnapshotterCron := func() {
-		_ = runSnapshotter()
+	// Find the outputs that hold a snapshot of the same cluster state already
+	var (
+		fingerprint string
+		unchanged   = map[string]bool{}
+	)
+	if c.SkipUnchanged.Enabled && state != nil {
+		fingerprint = checkUnchanged(ctx, state, snap, data.Time, c, outs, c.Force || run.Force, unchanged)
 	}
 
-	if c.Cron != "" {
-		logger.Info("Starting with cron expression: ", c.Cron)
+	// Export the snapshot to the outputs
+	run.setStep("upload")
+	results = processOutputs(ctx, snap.File, tmpl, data, outs, unchanged, checksErr == nil, c, run, env)
+	logRunSummary(ctx, results, time.Since(start))
+	recordOutputMetrics(cluster, results)
 
-		cron := cron.New()
-		cron.AddFunc(c.Cron, runSnapshotterCron)
-		cron.Start()
+	// an unknown state is left as it is, rather than overwritten with this run only
+	if state != nil {
+		recordState(ctx, consulWorker, state, results, snap, checksErr == nil, fingerprint, data.Time, c)
+	}
 
-		for {
-			select {
-			case <-ctx.Done():
-				return nil
-			}
+	if checksErr != nil {
+		return sanityError(checksErr, outputsError(results))
+	}
+	return outputsError(results)
+}
+
+// checkUnchanged fingerprints snap and adds the outputs that hold a snapshot with the same fingerprint in state,
+// uploaded less than skip-unchanged.max-interval before now, to unchanged (unless forced).
+// It returns the fingerprint.
+func checkUnchanged(ctx context.Context, state *backupState, snap *consul.Snapshot, now time.Time, c *config, outs []outputConfig, force bool, unchanged map[string]bool) string {
+	log := logger.FromContext(ctx)
+	fingerprint, err := consul.Fingerprint(snap.File, c.ConsulConfig.LockKey, c.ConsulConfig.StateKey)
+	if err != nil {
+		log.Warn("Could not fingerprint the snapshot, uploading it to every output: ", err)
+	}
+	log.Debug("Snapshot fingerprint: ", fingerprint)
+
+	if force {
+		log.Info("Forced: uploading the snapshot to every output, even if the cluster did not change")
+		return fingerprint
+	}
+	for _, oc := range outs {
+		if last, ok := state.unchanged(oc.Name, fingerprint, c.SkipUnchanged.MaxInterval, now); ok {
+			log.With("output", oc.Name).Info(fmt.Sprintf("Cluster unchanged since the snapshot uploaded at %v (index=%d), skipping", last.UploadedAt.Format(time.RFC3339), last.LastIndex))
+			unchanged[oc.Name] = true
 		}
-	} else {
-		logger.Info("Starting a single execution...")
-		return runSnapshotter()
 	}
+	return fingerprint
 }
 
-func processOutputs(snap string, c *config) error {
+// recordState records snap as the last one uploaded to the outputs that saved it, with skip-unchanged,
+// and as the last one that passed the sanity checks, if it did. It refreshes the heartbeat, even if every output was skipped.
+func recordState(ctx context.Context, w *consul.Worker, state *backupState, results []outputResult, snap *consul.Snapshot, sane bool, fingerprint string, now time.Time, c *config) {
+	state.Heartbeat = now
+	if c.SkipUnchanged.Enabled {
+		for _, r := range results {
+			if !r.Skipped && r.SaveErr == nil {
+				state.Outputs[r.Name] = outputState{LastIndex: snap.LastIndex, Fingerprint: fingerprint, UploadedAt: now}
+			}
+		}
+	}
+	if sane {
+		state.LastSnapshot = &snapshotState{LastIndex: snap.LastIndex, Size: snap.Size, TakenAt: now}
+	}
 
-	var errors error
+	stateCtx, cancel := withTimeout(ctx, c.Timeouts.Snapshot)
+	defer cancel()
+	if err := state.write(stateCtx, w, c.ConsulConfig.StateKey); err != nil {
+		logger.FromContext(ctx).Warn("Could not record the uploaded snapshots: ", err)
+	}
+}
 
-	outputFileName := fmt.Sprintf("%s%v%s", c.FilenamePrefix, time.Now().UnixNano(), c.FileExtension)
+// processOutputs exports snap to outs but the unchanged ones, running up to c.OutputConcurrency of them at once,
+// named after tmpl rendered with data, and applies their retention policies if prune is set. It records the result
+// of every output in run as soon as it is done, runs the post-output hooks with env after each one, and returns them all,
+// in the order of outs.
+func processOutputs(ctx context.Context, snap string, tmpl *naming.Template, data naming.Data, outs []outputConfig, unchanged map[string]bool, prune bool, c *config, run *backupRun, env hookEnv) []outputResult {
+	results := make([]outputResult, len(outs))
+	sem := make(chan struct{}, c.OutputConcurrency)
+	var wg sync.WaitGroup
 
-	for _, output := range c.Outputs {
-		switch output {
-		case "local":
-			logger.Info("===> Processing output: local")
+	// the top-level limit is shared by all the outputs of the run
+	global := c.Bandwidth.limiter()
+	if rate := global.Rate(); rate > 0 {
+		logger.FromContext(ctx).Info("Limiting the bandwidth of all the outputs to ", throttle.FormatRate(rate))
+	}
 
-			o := &outputs.LocalOutput{
-				DestinationPath:   c.LocalOutputConfig.DestinationPath,
-				Filename:          outputFileName,
-				CreateDestination: c.LocalOutputConfig.CreateDestination,
-				RetentionPeriod:   c.LocalOutputConfig.RetentionPeriod,
+	for i, oc := range outs {
+		if unchanged[oc.Name] {
+			results[i] = outputResult{Name: oc.Name, Type: oc.Type, Required: oc.Required, Skipped: true}
+			run.outputDone(results[i])
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, oc outputConfig) {
+			defer func() {
+				run.outputDone(results[i])
+				<-sem
+				wg.Done()
+			}()
+			ctx := logger.NewContext(ctx, logger.FromContext(ctx).With("output", oc.Name))
+			d := data
+			d.Output = oc.Name
+			outputFileName, err := tmpl.Render(d)
+			if err != nil {
+				logger.FromContext(ctx).Error("Could not name the snapshot: ", err)
+				results[i] = outputResult{Name: oc.Name, Type: oc.Type, Required: oc.Required, SaveErr: err}
+				return
 			}
-			if err := o.Save(snap); err != nil {
-				logger.Error(err)
-				errors = multierror.Append(errors, err)
-				continue
+			outputFileName = outputs.LayoutPath(oc.layout(), outputFileName, d.Time)
+			var limiters []*throttle.Limiter
+			if global != nil {
+				limiters = append(limiters, global)
 			}
-			if err := o.ApplyRetentionPolicy(); err != nil {
-				logger.Error(err)
-				errors = multierror.Append(errors, err)
-				continue
+			if own := oc.Bandwidth.limiter(); own != nil {
+				if rate := own.Rate(); rate > 0 {
+					logger.FromContext(ctx).Info("Limiting the bandwidth of the output to ", throttle.FormatRate(rate))
+				}
+				limiters = append(limiters, own)
 			}
-		case "azure_blob":
-			// Upload to Azure
-			logger.Info("===> Processing output: azure_blob")
-
-			o := &outputs.AzureBlobOutput{
-				AzureConfig: &azure.AzureConfig{
-					ContainerName:    c.AzureOutputConfig.ContainerName,
-					ContainerPath:    c.AzureOutputConfig.ContainerPath,
-					Filename:         outputFileName,
-					StorageAccount:   c.AzureOutputConfig.StorageAccount,
-					CloudDomain:      c.AzureOutputConfig.CloudDomain,
-					StorageAccessKey: c.AzureOutputConfig.StorageAccessKey,
-					StorageSASToken:  c.AzureOutputConfig.StorageSASToken,
-					CreateContainer:  c.AzureOutputConfig.CreateContainer,
-					BlockSize:        c.AzureOutputConfig.BlockSize,
-					Parallelism:      c.AzureOutputConfig.Parallelism,
-					Emulated:         c.AzureOutputConfig.Emulated,
-					EmulatorUrl:      c.AzureOutputConfig.EmulatorUrl,
-				},
-				RetentionPeriod: c.AzureOutputConfig.RetentionPeriod,
+			o := newOutput(oc, outputFileName, snapshotMatcher(c, tmpl, oc, data.Datacenter), limiters...)
+			// the retry policy of the output retries the uploads and the retention, and bounds how long it takes,
+			// which the SDK retrying each request on its own would multiply
+			if ao, ok := o.(*outputs.AzureBlobOutput); ok {
+				ao.AzureConfig.MaxRetries = -1
 			}
+			results[i] = processOutput(ctx, oc, o, snap, prune, c.Timeouts)
+			runHooks(ctx, c, hookPostOutput, env.withOutput(results[i], outputFileName))
+		}(i, oc)
+	}
+	wg.Wait()
 
-			if err := o.Save(snap); err != nil {
-				logger.Error(err)
-				errors = multierror.Append(errors, err)
-				continue
-			}
+	return results
+}
+
+// processOutput saves snap to o, then applies its retention policy if the snapshot was saved and prune is set.
+// Each step is retried on transient errors, as set by the retry policy of oc, and each attempt gets the full timeout.
+func processOutput(ctx context.Context, oc outputConfig, o outputs.Output, snap string, prune bool, timeouts timeoutsConfig) (r outputResult) {
+	log := logger.FromContext(ctx)
+	log.Info(fmt.Sprintf("===> Processing output: %s (%s)", oc.Name, oc.Type))
+
+	r = outputResult{Name: oc.Name, Type: oc.Type, Required: oc.Required}
+	start := time.Now()
+	defer func() { r.Duration = time.Since(start) }()
+
+	ctx, span := tracing.Start(ctx, "output", tracing.AttrOutput.String(oc.Name), tracing.AttrType.String(oc.Type))
+	defer func() {
+		span.SetAttributes(attribute.String("output.status", r.status()))
+		tracing.End(span, r.err())
+	}()
+
+	policy := oc.Retry.policy()
+
+	uploadCtx, uploadSpan := tracing.Start(ctx, "output.upload", tracing.AttrOutput.String(oc.Name))
+	r.SaveErr = policy.Do(uploadCtx, func(ctx context.Context) error {
+		var err error
+		r.Bytes, err = saveOutput(ctx, o, snap, timeouts.Upload)
+		return err
+	})
+	uploadSpan.SetAttributes(tracing.AttrBytes.Int64(r.Bytes))
+	tracing.End(uploadSpan, r.SaveErr)
+	if r.SaveErr != nil {
+		log.Error("Could not save snapshot: ", r.SaveErr)
+		return r
+	}
+	if !prune {
+		log.Warn("Keeping the older snapshots, as this one failed the sanity checks")
+		return r
+	}
 
-			if err := o.ApplyRetentionPolicy(); err != nil {
-				logger.Error(err)
-				errors = multierror.Append(errors, err)
-				continue
+	retentionCtx, retentionSpan := tracing.Start(ctx, "output.retention", tracing.AttrOutput.String(oc.Name))
+	r.RetentionErr = policy.Do(retentionCtx, func(ctx context.Context) error {
+		deleted, err := applyRetention(ctx, o, timeouts.Retention)
+		r.Deleted += deleted
+		return err
+	})
+	retentionSpan.SetAttributes(tracing.AttrDeleted.Int(r.Deleted))
+	tracing.End(retentionSpan, r.RetentionErr)
+	if r.RetentionErr != nil {
+		log.Error("Could not apply retention policy: ", r.RetentionErr)
+	}
+	return r
+}
+
+// selectOutputs returns the outputs named in names, in the order they are configured, or all of them if names is empty
+func selectOutputs(outs []outputConfig, names []string) ([]outputConfig, error) {
+	if len(names) == 0 {
+		return outs, nil
+	}
+
+	var selected []outputConfig
+	for _, oc := range outs {
+		if slices.Contains(names, oc.Name) {
+			selected = append(selected, oc)
+		}
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(selected, func(oc outputConfig) bool { return oc.Name == name }) {
+			return nil, fmt.Errorf("unknown output %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// newOutput creates the output for the instance oc, which saves the snapshot as filename, no faster than limiters allow
+func newOutput(oc outputConfig, filename string, match outputs.Matcher, limiters ...*throttle.Limiter) outputs.Output {
+	switch oc.Type {
+	case outputTypeLocal:
+		return &outputs.LocalOutput{
+			Name:              oc.Name,
+			DestinationPath:   oc.Local.DestinationPath,
+			Filename:          filename,
+			CreateDestination: oc.Local.CreateDestination,
+			RetentionPeriod:   oc.Local.RetentionPeriod,
+			Match:             match,
+			Limiters:          limiters,
+		}
+	case outputTypeAzureBlob:
+		return &outputs.AzureBlobOutput{
+			Name: oc.Name,
+			AzureConfig: &azure.AzureConfig{
+				ContainerName:    oc.AzureBlob.ContainerName,
+				ContainerPath:    oc.AzureBlob.ContainerPath,
+				Filename:         filename,
+				StorageAccount:   oc.AzureBlob.StorageAccount,
+				CloudDomain:      oc.AzureBlob.CloudDomain,
+				StorageAccessKey: oc.AzureBlob.StorageAccessKey,
+				StorageSASToken:  oc.AzureBlob.StorageSASToken,
+				CreateContainer:  oc.AzureBlob.CreateContainer,
+				BlockSize:        oc.AzureBlob.BlockSize,
+				Parallelism:      oc.AzureBlob.Parallelism,
+				Emulated:         oc.AzureBlob.Emulated,
+				EmulatorUrl:      oc.AzureBlob.EmulatorUrl,
+			},
+			RetentionPeriod: oc.AzureBlob.RetentionPeriod,
+			Match:           match,
+			Limiters:        limiters,
+		}
+	}
+	return nil
+}
+
+var (
+	defaultTemplate, _ = naming.New(naming.DefaultTemplate)
+	// legacyTemplate named the snapshots before outputs were named
+	legacyTemplate, _ = naming.New("{{.Prefix}}{{.Time.UnixNano}}{{.Extension}}")
+)
+
+// snapshotPatterns returns the patterns of the file names of the snapshots of the cluster datacenter (any, if empty)
+// saved by the output oc: the ones named after tmpl, then the ones named after the default template, so that changing
+// the template does not leave the older snapshots behind, and the ones named before outputs were named, if oc kept
+// the name the output had back then (its type). The names of those hold no output, so that no other output may claim them.
+func snapshotPatterns(c *config, tmpl *naming.Template, oc outputConfig, datacenter string) []*naming.Pattern {
+	d := naming.Data{Datacenter: datacenter, Output: oc.Name, Prefix: c.FilenamePrefix, Extension: c.FileExtension}
+	patterns := []*naming.Pattern{tmpl.Pattern(d), defaultTemplate.Pattern(d)}
+	if oc.Name == oc.Type {
+		patterns = append(patterns, legacyTemplate.Pattern(d))
+	}
+	return patterns
+}
+
+// snapshotMatcher matches the file names of the snapshots of the cluster datacenter (any, if empty)
+// saved by the output oc, in any layout
+func snapshotMatcher(c *config, tmpl *naming.Template, oc outputConfig, datacenter string) outputs.Matcher {
+	patterns := snapshotPatterns(c, tmpl, oc, datacenter)
+	return outputs.WithLayouts(func(file string) bool {
+		for _, p := range patterns {
+			if p.Match(file) {
+				return true
 			}
 		}
+		return false
+	})
+}
+
+// newRunID returns a random ID for a backup run
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func saveOutput(ctx context.Context, o outputs.Output, snap string, timeout time.Duration) (int64, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	return o.Save(ctx, snap)
+}
+
+func applyRetention(ctx context.Context, o outputs.Output, timeout time.Duration) (int, error) {
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+	return o.ApplyRetentionPolicy(ctx)
+}
+
+// withTimeout returns a child context of ctx bounded by timeout, or just a cancellable one if timeout is not positive
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
 	}
-	return errors
+	return context.WithCancel(ctx)
 }
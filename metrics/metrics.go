@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "consul_snapshotter"
+
+// the cluster label holds the datacenter of the Consul agent, and the output label the name of the output
+var (
+	Runs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "runs_total",
+		Help:      "Number of backup runs, by result.",
+	}, []string{"cluster", "result"})
+
+	RunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of the backup runs, by result.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"cluster", "result"})
+
+	LockFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lock_failures_total",
+		Help:      "Number of times the lock could not be acquired, because another process held it (busy) or Consul failed (error).",
+	}, []string{"cluster", "reason"})
+
+	SnapshotSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "snapshot_size_bytes",
+		Help:      "Size of the last snapshot taken.",
+	}, []string{"cluster"})
+
+	SnapshotIndex = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "snapshot_raft_index",
+		Help:      "Raft index the last snapshot was taken at.",
+	}, []string{"cluster"})
+
+	LastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Time the output last held an up-to-date snapshot, either saved by the run or skipped as unchanged.",
+	}, []string{"cluster", "output"})
+
+	UploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_bytes_total",
+		Help:      "Number of bytes of the snapshots saved to the output.",
+	}, []string{"cluster", "output"})
+
+	UploadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_errors_total",
+		Help:      "Number of runs the output could not save the snapshot in, after retries.",
+	}, []string{"cluster", "output"})
+
+	RetentionDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_deletions_total",
+		Help:      "Number of snapshots removed from the output by its retention policy.",
+	}, []string{"cluster", "output"})
+
+	RetentionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_errors_total",
+		Help:      "Number of runs the output could not apply its retention policy in, after retries.",
+	}, []string{"cluster", "output"})
+
+	SanityCheckFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sanity_check_failures_total",
+		Help:      "Number of snapshots that failed each sanity check.",
+	}, []string{"cluster", "check"})
+
+	RestoreVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "restore_verifications_total",
+		Help:      "Number of restore verifications of the latest snapshot of the output, by result.",
+	}, []string{"cluster", "output", "result"})
+
+	LastRestoreVerified = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_restore_verified_timestamp_seconds",
+		Help:      "Time the latest snapshot of the output was last restored, and passed the sanity checks.",
+	}, []string{"cluster", "output"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Runs,
+		RunDuration,
+		LockFailures,
+		SnapshotSize,
+		SnapshotIndex,
+		LastSuccess,
+		UploadBytes,
+		UploadErrors,
+		RetentionDeletions,
+		RetentionErrors,
+		SanityCheckFailures,
+		RestoreVerifications,
+		LastRestoreVerified,
+	)
+}
+
+// Handler serves the metrics in the Prometheus format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
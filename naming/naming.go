@@ -0,0 +1,341 @@
+package naming
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// DefaultTemplate names the snapshots as "<prefix><output>-<unix time in ns><extension>"
+const DefaultTemplate = "{{.Prefix}}{{.Output}}-{{.Time.UnixNano}}{{.Extension}}"
+
+// Data holds the values a template can use
+type Data struct {
+	Datacenter string
+	NodeName   string
+	Hostname   string
+	RunID      string
+	Output     string
+	Prefix     string
+	Extension  string
+	LastIndex  uint64
+	Time       time.Time
+}
+
+// funcs are the functions a template can pipe the time to
+var funcs = template.FuncMap{
+	"rfc3339": func(t time.Time) string { return t.Format(time.RFC3339) },
+	"unix":    func(t time.Time) int64 { return t.Unix() },
+}
+
+// stringFields are the fields of Data that a template can use as they are
+var stringFields = map[string]bool{
+	"Datacenter": true,
+	"NodeName":   true,
+	"Hostname":   true,
+	"RunID":      true,
+	"Output":     true,
+	"Prefix":     true,
+	"Extension":  true,
+}
+
+// Template renders the names of the snapshots, and parses them back
+type Template struct {
+	text  string
+	tmpl  *template.Template
+	parts []part
+}
+
+// part is a piece of a template: either literal text, or a field with the format it is rendered with
+type part struct {
+	text   string
+	field  string
+	layout string // time layout, or "unix" or "unixnano"
+}
+
+// New parses text as a template. Besides literal text, it may only contain actions that print a field of Data
+// (e.g. "{{.Datacenter}}"), or the time as "{{.Time.Format "<layout>"}}", "{{.Time | rfc3339}}", "{{.Time | unix}}",
+// "{{.Time.Unix}}" or "{{.Time.UnixNano}}", so that the names it renders can be parsed back.
+func New(text string) (*Template, error) {
+	tmpl, err := template.New("filename").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Template{text: text, tmpl: tmpl}
+	for _, node := range tmpl.Tree.Root.Nodes {
+		p, err := parseNode(node)
+		if err != nil {
+			return nil, err
+		}
+		t.parts = append(t.parts, p)
+	}
+	return t, nil
+}
+
+// parseNode converts a node of the template into a part
+func parseNode(node parse.Node) (part, error) {
+	switch node := node.(type) {
+	case *parse.TextNode:
+		return part{text: string(node.Text)}, nil
+	case *parse.ActionNode:
+		if p, ok := parseAction(node.Pipe); ok {
+			return p, nil
+		}
+	}
+	return part{}, fmt.Errorf("unsupported action %s (only fields of the snapshot and the formatted time can be used)", node)
+}
+
+func parseAction(pipe *parse.PipeNode) (part, bool) {
+	if len(pipe.Decl) > 0 || len(pipe.Cmds) == 0 {
+		return part{}, false
+	}
+
+	// the first command gives the field, and may format the time
+	first := pipe.Cmds[0].Args
+	field, ok := first[0].(*parse.FieldNode)
+	if !ok {
+		return part{}, false
+	}
+
+	var p part
+	switch {
+	case len(field.Ident) == 1 && stringFields[field.Ident[0]] && len(first) == 1:
+		p = part{field: field.Ident[0]}
+	case len(field.Ident) == 1 && field.Ident[0] == "LastIndex" && len(first) == 1:
+		p = part{field: "LastIndex"}
+	case len(field.Ident) == 1 && field.Ident[0] == "Time" && len(first) == 1:
+		p = part{field: "Time"}
+	case len(field.Ident) == 2 && field.Ident[0] == "Time" && field.Ident[1] == "Format" && len(first) == 2:
+		layout, ok := first[1].(*parse.StringNode)
+		if !ok {
+			return part{}, false
+		}
+		p = part{field: "Time", layout: layout.Text}
+	case len(field.Ident) == 2 && field.Ident[0] == "Time" && field.Ident[1] == "Unix" && len(first) == 1:
+		p = part{field: "Time", layout: "unix"}
+	case len(field.Ident) == 2 && field.Ident[0] == "Time" && field.Ident[1] == "UnixNano" && len(first) == 1:
+		p = part{field: "Time", layout: "unixnano"}
+	default:
+		return part{}, false
+	}
+
+	// the time may be piped to one of funcs
+	switch len(pipe.Cmds) {
+	case 1:
+		if p.field == "Time" && p.layout == "" {
+			// printed as by time.Time.String, which does not parse back
+			return part{}, false
+		}
+		return p, true
+	case 2:
+		args := pipe.Cmds[1].Args
+		if p.field != "Time" || p.layout != "" || len(args) != 1 {
+			return part{}, false
+		}
+		fn, ok := args[0].(*parse.IdentifierNode)
+		if !ok {
+			return part{}, false
+		}
+		switch fn.Ident {
+		case "rfc3339":
+			p.layout = time.RFC3339
+		case "unix":
+			p.layout = "unix"
+		default:
+			return part{}, false
+		}
+		return p, true
+	}
+	return part{}, false
+}
+
+// String returns the text of the template
+func (t *Template) String() string {
+	return t.text
+}
+
+// Uses reports whether the template uses the given field of Data
+func (t *Template) Uses(field string) bool {
+	for _, p := range t.parts {
+		if p.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Render returns the name of a snapshot, as a slash-separated path relative to the root of an output
+func (t *Template) Render(d Data) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, d); err != nil {
+		return "", err
+	}
+	name := buf.String()
+
+	if name == "" || strings.HasPrefix(name, "/") || path.Clean(name) != name || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("invalid snapshot name %q: must be a relative path, without empty, '.' or '..' elements", name)
+	}
+	return name, nil
+}
+
+// Pattern matches the names rendered by a template for a given output
+type Pattern struct {
+	re    *regexp.Regexp
+	parts []part
+}
+
+// Pattern returns the pattern of the names rendered with the Output, Prefix, Extension and Datacenter of d,
+// so that the outputs and clusters sharing a destination do not claim each other's snapshots. An empty Datacenter
+// matches any value (e.g. to list the snapshots of every cluster), as do all the other fields, which may change
+// between runs (e.g. the hostname).
+func (t *Template) Pattern(d Data) *Pattern {
+	known := map[string]string{"Output": d.Output, "Prefix": d.Prefix, "Extension": d.Extension, "Datacenter": d.Datacenter}
+
+	var expr strings.Builder
+	var groups []part
+	expr.WriteString("^")
+	for _, p := range t.parts {
+		switch {
+		case p.field == "":
+			expr.WriteString(regexp.QuoteMeta(p.text))
+		case p.field == "Output" || p.field == "Prefix" || p.field == "Extension" || (p.field == "Datacenter" && d.Datacenter != ""):
+			expr.WriteString(regexp.QuoteMeta(known[p.field]))
+		case p.field == "LastIndex":
+			expr.WriteString("([0-9]+)")
+			groups = append(groups, p)
+		case p.field == "Time":
+			expr.WriteString("(" + layoutRegexp(p.layout) + ")")
+			groups = append(groups, p)
+		default:
+			expr.WriteString("([^/]+?)")
+			groups = append(groups, p)
+		}
+	}
+	expr.WriteString("$")
+
+	return &Pattern{re: regexp.MustCompile(expr.String()), parts: groups}
+}
+
+// Match reports whether name was rendered by the template
+func (p *Pattern) Match(name string) bool {
+	return p.re.MatchString(name)
+}
+
+// Parse returns the fields of Data found in name, and whether name was rendered by the template.
+// The time is the most precise one found in name, or the zero time if none could be parsed.
+func (p *Pattern) Parse(name string) (Data, bool) {
+	m := p.re.FindStringSubmatch(name)
+	if m == nil {
+		return Data{}, false
+	}
+
+	var d Data
+	for i, part := range p.parts {
+		value := m[i+1]
+		switch part.field {
+		case "Datacenter":
+			d.Datacenter = value
+		case "NodeName":
+			d.NodeName = value
+		case "Hostname":
+			d.Hostname = value
+		case "RunID":
+			d.RunID = value
+		case "LastIndex":
+			d.LastIndex, _ = strconv.ParseUint(value, 10, 64)
+		case "Time":
+			// truncated times (e.g. a date) are never after the precise one
+			if t, err := parseTime(part.layout, value); err == nil && t.After(d.Time) {
+				d.Time = t
+			}
+		}
+	}
+	return d, true
+}
+
+func parseTime(layout, value string) (time.Time, error) {
+	switch layout {
+	case "unix", "unixnano":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if layout == "unix" {
+			return time.Unix(n, 0).UTC(), nil
+		}
+		return time.Unix(0, n).UTC(), nil
+	}
+	return time.Parse(layout, value)
+}
+
+// layoutElements maps the elements of time layouts to the pattern of the values they format.
+// Longer elements come first, as they are matched in order.
+var layoutElements = []struct {
+	element string
+	pattern string
+}{
+	{"2006", "[0-9]{4}"},
+	{"Z07:00", "(?:Z|[+-][0-9]{2}:[0-9]{2})"},
+	{"Z0700", "(?:Z|[+-][0-9]{4})"},
+	{"-07:00", "[+-][0-9]{2}:[0-9]{2}"},
+	{"-0700", "[+-][0-9]{4}"},
+	{"January", "[A-Za-z]+"},
+	{"Monday", "[A-Za-z]+"},
+	{"Jan", "[A-Za-z]{3}"},
+	{"Mon", "[A-Za-z]{3}"},
+	{"MST", "[A-Za-z]+"},
+	{".000000000", `\.[0-9]{9}`},
+	{".000000", `\.[0-9]{6}`},
+	{".000", `\.[0-9]{3}`},
+	{".999999999", `(?:\.[0-9]+)?`},
+	{".999999", `(?:\.[0-9]+)?`},
+	{".999", `(?:\.[0-9]+)?`},
+	{"01", "[0-9]{2}"},
+	{"02", "[0-9]{2}"},
+	{"03", "[0-9]{2}"},
+	{"04", "[0-9]{2}"},
+	{"05", "[0-9]{2}"},
+	{"06", "[0-9]{2}"},
+	{"15", "[0-9]{2}"},
+	{"PM", "[AP]M"},
+	{"pm", "[ap]m"},
+	{"_2", "[ 0-9][0-9]"},
+	{"1", "[0-9]{1,2}"},
+	{"2", "[0-9]{1,2}"},
+	{"3", "[0-9]{1,2}"},
+	{"4", "[0-9]{1,2}"},
+	{"5", "[0-9]{1,2}"},
+}
+
+// layoutRegexp returns the pattern of the times formatted with layout
+func layoutRegexp(layout string) string {
+	switch layout {
+	case "unix", "unixnano":
+		return "[0-9]+"
+	}
+
+	var expr strings.Builder
+	for layout != "" {
+		matched := false
+		for _, e := range layoutElements {
+			if strings.HasPrefix(layout, e.element) {
+				expr.WriteString(e.pattern)
+				layout = layout[len(e.element):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			expr.WriteString(regexp.QuoteMeta(layout[:1]))
+			layout = layout[1:]
+		}
+	}
+	return expr.String()
+}
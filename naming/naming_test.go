@@ -0,0 +1,161 @@
+package naming
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// readmeTemplate is the example of the README
+const readmeTemplate = `{{.Datacenter}}/{{.Time.Format "2006/01/02"}}/consul-{{.LastIndex}}-{{.Time | rfc3339}}.snap`
+
+var testData = Data{
+	Datacenter: "dc1",
+	NodeName:   "node-1",
+	Hostname:   "backup.example.com",
+	RunID:      "a1b2c3d4",
+	Output:     "local",
+	Prefix:     "consul-snapshot-",
+	Extension:  ".snap",
+	LastIndex:  4242,
+	Time:       time.Date(2026, 10, 18, 13, 4, 5, 123456789, time.UTC),
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+		// precision is what the time parsed back is truncated to
+		precision time.Duration
+	}{
+		{name: "default", text: DefaultTemplate, want: "consul-snapshot-local-1792328645123456789.snap", precision: time.Nanosecond},
+		{name: "readme", text: readmeTemplate, want: "dc1/2026/10/18/consul-4242-2026-10-18T13:04:05Z.snap", precision: time.Second},
+		{name: "unix", text: "{{.Prefix}}{{.Time.Unix}}{{.Extension}}", want: "consul-snapshot-1792328645.snap", precision: time.Second},
+		{name: "unix func", text: "{{.Time | unix}}-{{.RunID}}", want: "1792328645-a1b2c3d4", precision: time.Second},
+		{name: "date only", text: `{{.Time.Format "20060102"}}/{{.RunID}}`, want: "20261018/a1b2c3d4", precision: 24 * time.Hour},
+		{name: "named month and millis", text: `{{.Time.Format "02-Jan-2006_15.04.05.000"}}-{{.LastIndex}}`, want: "18-Oct-2026_13.04.05.123-4242", precision: time.Millisecond},
+		{name: "micros and numeric zone", text: `{{.Time.Format "2006-01-02T150405.000000-0700"}}`, want: "2026-10-18T130405.123456+0000", precision: time.Microsecond},
+		{name: "optional fraction", text: `{{.Time.Format "2006-01-02T15:04:05.999999999Z07:00"}}`, want: "2026-10-18T13:04:05.123456789Z", precision: time.Nanosecond},
+		{name: "weekday, padded day and zone name", text: `{{.Time.Format "Mon Jan _2 15:04:05 MST 2006"}}.snap`, want: "Sun Oct 18 13:04:05 UTC 2026.snap", precision: time.Second},
+		{name: "12-hour clock", text: `{{.Time.Format "2006-1-2_3.04.05PM"}}`, want: "2026-10-18_1.04.05PM", precision: time.Second},
+		{name: "every string field", text: `{{.Datacenter}}/{{.NodeName}}/{{.Hostname}}/{{.Prefix}}{{.Output}}-{{.RunID}}{{.Extension}}`, want: "dc1/node-1/backup.example.com/consul-snapshot-local-a1b2c3d4.snap"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := New(tt.text)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			name, err := tmpl.Render(testData)
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			if name != tt.want {
+				t.Errorf("Render() = %q, want %q", name, tt.want)
+			}
+
+			for _, pinned := range []Data{
+				{Output: testData.Output, Prefix: testData.Prefix, Extension: testData.Extension},
+				{Output: testData.Output, Prefix: testData.Prefix, Extension: testData.Extension, Datacenter: testData.Datacenter},
+			} {
+				d, ok := tmpl.Pattern(pinned).Parse(name)
+				if !ok {
+					t.Fatalf("Pattern(%+v).Parse(%q) did not match", pinned, name)
+				}
+				if tmpl.Uses("Time") {
+					if want := testData.Time.Truncate(tt.precision); !d.Time.Equal(want) {
+						t.Errorf("parsed time = %v, want %v", d.Time, want)
+					}
+				}
+				if tmpl.Uses("LastIndex") && d.LastIndex != testData.LastIndex {
+					t.Errorf("parsed index = %d, want %d", d.LastIndex, testData.LastIndex)
+				}
+				for field, v := range map[string][2]string{
+					"NodeName": {d.NodeName, testData.NodeName},
+					"Hostname": {d.Hostname, testData.Hostname},
+					"RunID":    {d.RunID, testData.RunID},
+				} {
+					if tmpl.Uses(field) && v[0] != v[1] {
+						t.Errorf("parsed %s = %q, want %q", field, v[0], v[1])
+					}
+				}
+				if tmpl.Uses("Datacenter") && pinned.Datacenter == "" && d.Datacenter != testData.Datacenter {
+					t.Errorf("parsed datacenter = %q, want %q", d.Datacenter, testData.Datacenter)
+				}
+			}
+		})
+	}
+}
+
+func TestPatternRejects(t *testing.T) {
+	legacy := "{{.Prefix}}{{.Time.UnixNano}}{{.Extension}}"
+	tests := []struct {
+		name string
+		text string
+		file string
+	}{
+		{name: "other output", text: DefaultTemplate, file: "consul-snapshot-azure-1792328645123456789.snap"},
+		{name: "output sharing a prefix", text: DefaultTemplate, file: "consul-snapshot-local-dr-1792328645123456789.snap"},
+		{name: "other prefix", text: DefaultTemplate, file: "vault-snapshot-local-1792328645123456789.snap"},
+		{name: "other extension", text: DefaultTemplate, file: "consul-snapshot-local-1792328645123456789.snap.gz"},
+		{name: "partial upload", text: DefaultTemplate, file: "consul-snapshot-local-1792328645123456789.snap.tmp"},
+		{name: "not a time", text: DefaultTemplate, file: "consul-snapshot-local-latest.snap"},
+		{name: "in a directory", text: DefaultTemplate, file: "old/consul-snapshot-local-1792328645123456789.snap"},
+		{name: "stray file", text: DefaultTemplate, file: "notes.txt"},
+		{name: "default name for the legacy template", text: legacy, file: "consul-snapshot-local-1792328645123456789.snap"},
+		{name: "other datacenter", text: readmeTemplate, file: "dc2/2026/10/18/consul-4242-2026-10-18T13:04:05Z.snap"},
+		{name: "datacenter sharing a prefix", text: readmeTemplate, file: "dc10/2026/10/18/consul-4242-2026-10-18T13:04:05Z.snap"},
+		{name: "missing directory", text: readmeTemplate, file: "dc1/consul-4242-2026-10-18T13:04:05Z.snap"},
+		{name: "malformed date", text: readmeTemplate, file: "dc1/2026/10/1/consul-4242-2026-10-18T13:04:05Z.snap"},
+		{name: "not an index", text: readmeTemplate, file: "dc1/2026/10/18/consul-x-2026-10-18T13:04:05Z.snap"},
+		{name: "string field across directories", text: "{{.RunID}}.snap", file: "a/b.snap"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := New(tt.text)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			p := tmpl.Pattern(Data{Datacenter: "dc1", Output: "local", Prefix: "consul-snapshot-", Extension: ".snap"})
+			if p.Match(tt.file) {
+				t.Errorf("Pattern of %q matches %q", tt.text, tt.file)
+			}
+			if _, ok := p.Parse(tt.file); ok {
+				t.Errorf("Pattern of %q parses %q", tt.text, tt.file)
+			}
+		})
+	}
+}
+
+func TestNewRejects(t *testing.T) {
+	for _, text := range []string{
+		"{{if .Output}}{{.Output}}{{end}}-{{.RunID}}",
+		"{{.Time}}.snap",
+		`{{.Time | printf "%v"}}.snap`,
+		"{{.Unknown}}.snap",
+		"{{.Output | unix}}.snap",
+		"{{$x := .RunID}}{{$x}}",
+		"{{.RunID",
+	} {
+		if _, err := New(text); err == nil {
+			t.Errorf("New(%q) succeeded", text)
+		}
+	}
+}
+
+func TestRenderRejects(t *testing.T) {
+	for _, d := range []Data{
+		{Datacenter: "..", RunID: "x"},
+		{Datacenter: "", RunID: "x"},
+		{Datacenter: "dc1/.", RunID: "x"},
+	} {
+		tmpl, err := New("{{.Datacenter}}/{{.RunID}}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name, err := tmpl.Render(d); err == nil || !strings.Contains(err.Error(), "invalid snapshot name") {
+			t.Errorf("Render(%+v) = %q, %v, want an invalid name", d, name, err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ruizink/consul-snapshotter/consul"
+	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/notify"
+)
+
+// newNotifier builds the notifier of nc
+func newNotifier(nc notifierConfig, client *http.Client) (notify.Notifier, error) {
+	switch nc.Type {
+	case notifierTypeSlack:
+		return &notify.Slack{URL: nc.URL, Client: client}, nil
+	case notifierTypeTeams:
+		return &notify.Teams{URL: nc.URL, Client: client}, nil
+	case notifierTypePagerDuty:
+		url := nc.URL
+		if url == "" {
+			url = notify.PagerDutyURL
+		}
+		return &notify.PagerDuty{URL: url, RoutingKey: nc.RoutingKey, Client: client}, nil
+	case notifierTypeSMTP:
+		subject, err := notify.ParseTemplate("subject", nc.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subject template: %v", err)
+		}
+		body, err := notify.ParseTemplate("body", nc.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body template: %v", err)
+		}
+		return &notify.Email{
+			Address:  net.JoinHostPort(nc.Host, strconv.Itoa(nc.Port)),
+			TLS:      nc.TLS,
+			Username: nc.Username,
+			Password: nc.Password,
+			From:     nc.From,
+			To:       nc.To,
+			Subject:  subject,
+			Body:     body,
+		}, nil
+	default:
+		return &notify.Webhook{URL: nc.URL, Authorization: nc.Authorization, Client: client}, nil
+	}
+}
+
+// notifyRun sends the event of a run, started at start and ended with err, to the notifiers that want it.
+// snap is the snapshot it took, if any. Runs that found the lock busy, or that were cancelled through the control API, are not notified.
+func (s *snapshotter) notifyRun(ctx context.Context, c *config, run *backupRun, cluster string, start time.Time, snap *consul.Snapshot, results []outputResult, err error, recovered bool) {
+	if len(c.Notifiers) == 0 || exitCode(err) == exitLockBusy || run.wasCancelled() {
+		return
+	}
+
+	e := notify.Event{
+		Cluster:   clusterName(c, cluster),
+		RunID:     run.ID,
+		Trigger:   run.Trigger,
+		Result:    runResult(err),
+		StartedAt: start.UTC(),
+		Duration:  time.Since(start).Round(time.Millisecond).String(),
+	}
+	if err != nil {
+		// multierror lists end with blank lines
+		e.Error = strings.TrimSpace(err.Error())
+	}
+	if snap != nil {
+		e.Index, e.Size = snap.LastIndex, snap.Size
+	}
+	saved := 0
+	for _, r := range results {
+		o := notify.OutputEvent{Name: r.Name, Status: r.status(), Bytes: r.Bytes, Deleted: r.Deleted}
+		if err := r.err(); err != nil {
+			o.Error = err.Error()
+		}
+		if r.SaveErr == nil {
+			saved++
+		}
+		e.Outputs = append(e.Outputs, o)
+	}
+
+	var kinds []string
+	switch {
+	case err != nil:
+		kinds = []string{notify.EventFailure}
+		e.Summary = fmt.Sprintf("Consul snapshot backup failed on %s: %s (%d/%d outputs saved)", e.Cluster, e.Result, saved, len(results))
+	case recovered:
+		// notifiers that do not want recoveries get them as successes
+		kinds = []string{notify.EventRecovered, notify.EventSuccess}
+		e.Summary = fmt.Sprintf("Consul snapshot backup recovered on %s (%d/%d outputs saved)", e.Cluster, saved, len(results))
+	default:
+		kinds = []string{notify.EventSuccess}
+		e.Summary = fmt.Sprintf("Consul snapshot backup succeeded on %s (%d/%d outputs saved)", e.Cluster, saved, len(results))
+	}
+
+	s.send(ctx, c, func(nc notifierConfig) (notify.Event, bool) {
+		for _, kind := range kinds {
+			if nc.wants(kind) {
+				e.Kind = kind
+				return e, true
+			}
+		}
+		return e, false
+	})
+}
+
+// sendDigest sends the digest of the runs since the last one to the notifiers that want it
+func (s *snapshotter) sendDigest() {
+	c := s.currentConfig()
+	d := s.digest.take()
+	e := notify.Event{
+		Kind:    notify.EventDigest,
+		Cluster: clusterName(c, s.digest.cluster()),
+		Summary: fmt.Sprintf("Consul snapshot backups since %s: %d runs, %d failed", d.Since.Format(time.RFC3339), d.Runs, d.Failed),
+		Digest:  d,
+	}
+	s.send(context.Background(), c, func(nc notifierConfig) (notify.Event, bool) {
+		return e, nc.wants(notify.EventDigest)
+	})
+}
+
+// send sends the event returned by event to every notifier it returns true for, all at once, only logging the errors
+func (s *snapshotter) send(ctx context.Context, c *config, event func(nc notifierConfig) (notify.Event, bool)) {
+	ctx = context.WithoutCancel(ctx)
+	log := logger.FromContext(ctx)
+	client := &http.Client{Timeout: c.Notifications.Timeout}
+
+	var wg sync.WaitGroup
+	for _, nc := range c.Notifiers {
+		e, ok := event(nc)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := log.With("notifier", nc.Name, "event", e.Kind)
+			ctx, cancel := context.WithTimeout(ctx, c.Notifications.Timeout)
+			defer cancel()
+			n, err := newNotifier(nc, client)
+			if err == nil {
+				err = n.Notify(ctx, e)
+			}
+			if err != nil {
+				l.Error("Could not send the notification: ", err)
+				return
+			}
+			l.Debug("Sent the notification")
+		}()
+	}
+	wg.Wait()
+}
+
+// sendsDigests reports whether any notifier of c wants digests
+func sendsDigests(c *config) bool {
+	for _, nc := range c.Notifiers {
+		if nc.wants(notify.EventDigest) {
+			return true
+		}
+	}
+	return false
+}
+
+// digestsChanged reports whether the digests are sent on a different schedule in new than in old
+func digestsChanged(old, new *config) bool {
+	if sendsDigests(old) != sendsDigests(new) {
+		return true
+	}
+	return sendsDigests(new) && old.Notifications.DigestSchedule != new.Notifications.DigestSchedule
+}
+
+// clusterName names the cluster in the notifications: its datacenter, or the address of Consul if it is unknown
+func clusterName(c *config, datacenter string) string {
+	if datacenter != "" {
+		return datacenter
+	}
+	return c.ConsulConfig.URL
+}
+
+// runDigest sums up the runs since the last digest was taken
+type runDigest struct {
+	// guards all the fields below
+	mu         sync.Mutex
+	since      time.Time
+	runs       int
+	failed     int
+	datacenter string
+	outputs    map[string]*notify.DigestOutput
+}
+
+// recordRun adds a run of the datacenter, which ended with err after exporting the snapshot as in results
+func (d *runDigest) recordRun(datacenter string, results []outputResult, err error) {
+	if exitCode(err) == exitLockBusy {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if datacenter != "" {
+		d.datacenter = datacenter
+	}
+
+	d.runs++
+	if err != nil {
+		d.failed++
+	}
+	if d.outputs == nil {
+		d.outputs = map[string]*notify.DigestOutput{}
+	}
+	now := time.Now().UTC()
+	for _, r := range results {
+		o, ok := d.outputs[r.Name]
+		if !ok {
+			o = &notify.DigestOutput{Name: r.Name}
+			d.outputs[r.Name] = o
+		}
+		switch {
+		case r.SaveErr != nil:
+			o.Failed++
+		case !r.Skipped:
+			o.Saved++
+			o.Bytes += r.Bytes
+			o.LastSuccess = now
+		}
+	}
+}
+
+func (d *runDigest) cluster() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.datacenter
+}
+
+// take returns the digest of the runs since the last one was taken, and starts a new one
+func (d *runDigest) take() *notify.Digest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC()
+	digest := &notify.Digest{
+		Since:   d.since,
+		Until:   now,
+		Runs:    d.runs,
+		Failed:  d.failed,
+		Outputs: []notify.DigestOutput{},
+	}
+	for _, o := range d.outputs {
+		digest.Outputs = append(digest.Outputs, *o)
+	}
+	sort.Slice(digest.Outputs, func(i, j int) bool { return digest.Outputs[i].Name < digest.Outputs[j].Name })
+
+	d.since, d.runs, d.failed, d.outputs = now, 0, 0, nil
+	return digest
+}
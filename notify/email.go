@@ -0,0 +1,238 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// TLS modes of the SMTP connections
+const (
+	// TLSStartTLS upgrades the connection with STARTTLS, failing if the server does not offer it
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects over TLS from the start (e.g. on port 465)
+	TLSImplicit = "tls"
+	// TLSNone sends the emails in the clear, e.g. to a local relay
+	TLSNone = "none"
+)
+
+// TLSModes are the TLS modes of the SMTP connections
+var TLSModes = []string{TLSStartTLS, TLSImplicit, TLSNone}
+
+// DefaultSubject and DefaultBody are the templates of the emails, executed with the Event
+const (
+	DefaultSubject = "[consul-snapshotter] {{.Summary}}"
+	DefaultBody    = `{{.Summary}}
+{{with .Digest}}
+Period:  {{.Since.Format "2006-01-02 15:04:05 MST"}} - {{.Until.Format "2006-01-02 15:04:05 MST"}}
+Runs:    {{.Runs}} ({{.Failed}} failed)
+
+Outputs:
+{{range .Outputs}}  {{.Name}}: {{.Saved}} saved, {{.Failed}} failed, {{bytes .Bytes}}, last success: {{if .LastSuccess.IsZero}}never{{else}}{{.LastSuccess.Format "2006-01-02 15:04:05 MST"}}{{end}}
+{{end}}{{else}}
+Cluster:  {{.Cluster}}
+Result:   {{.Result}}
+Run:      {{.RunID}} ({{.Trigger}}, took {{.Duration}})
+{{if .Index}}Snapshot: index {{.Index}}, {{bytes .Size}}
+{{end}}{{with .Restore}}Restored: {{.Snapshot}}, from {{.Output}}
+Contents: {{.KVEntries}} KV entries, {{.Nodes}} nodes, {{.Services}} services
+{{end}}{{if .Error}}Error:    {{.Error}}
+{{end}}{{if .Outputs}}
+Outputs:
+{{range .Outputs}}  {{.Name}}: {{.Status}}, {{bytes .Bytes}} saved, {{.Deleted}} deleted by retention{{if .Error}}
+    error: {{.Error}}{{end}}
+{{end}}{{end}}{{end}}`
+)
+
+// TemplateFuncs are the functions available to the templates of the emails
+var TemplateFuncs = template.FuncMap{
+	"bytes": formatBytes,
+}
+
+// Email sends the events by email, through an SMTP server
+type Email struct {
+	// Address is the host:port of the SMTP server
+	Address string
+	TLS     string
+	// Username and Password authenticate with PLAIN, if Username is set
+	Username string
+	Password string
+	From     string
+	To       []string
+	Subject  *template.Template
+	Body     *template.Template
+
+	// rootCAs verify the certificate of the server instead of the system roots, if set
+	rootCAs *x509.CertPool
+}
+
+// ParseTemplate parses a template of the emails
+func ParseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(TemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+func (n *Email) Notify(ctx context.Context, e Event) error {
+	msg, err := n.message(e)
+	if err != nil {
+		return err
+	}
+	if err := n.send(ctx, msg); err != nil {
+		return fmt.Errorf("error sending the email: %v", err)
+	}
+	return nil
+}
+
+// message renders the email of e, with its headers
+func (n *Email) message(e Event) ([]byte, error) {
+	var subject, body bytes.Buffer
+	if err := n.Subject.Execute(&subject, e); err != nil {
+		return nil, fmt.Errorf("error rendering the subject: %v", err)
+	}
+	if err := n.Body.Execute(&body, e); err != nil {
+		return nil, fmt.Errorf("error rendering the body: %v", err)
+	}
+
+	host, _, _ := net.SplitHostPort(n.Address)
+	var msg bytes.Buffer
+	to := make([]string, len(n.To))
+	for i, addr := range n.To {
+		to[i] = header(addr)
+	}
+	fmt.Fprintf(&msg, "From: %s\r\n", header(n.From))
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	// subjects are a single line
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", messageID(), host)
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	qp := quotedprintable.NewWriter(&msg)
+	if _, err := qp.Write(bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// send delivers msg to the recipients, giving up once ctx is done
+func (n *Email) send(ctx context.Context, msg []byte) error {
+	host, _, err := net.SplitHostPort(n.Address)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{ServerName: host, RootCAs: n.rootCAs}
+
+	var conn net.Conn
+	if n.TLS == TLSImplicit {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", n.Address)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", n.Address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// net/smtp has no context of its own
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if n.TLS == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not offer STARTTLS", n.Address)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("%s does not offer authentication", n.Address)
+		}
+		if err := c.Auth(smtp.PlainAuth("", n.Username, n.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(envelope(n.From)); err != nil {
+		return err
+	}
+	for _, to := range n.To {
+		if err := c.Rcpt(envelope(to)); err != nil {
+			return fmt.Errorf("recipient %s: %v", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// header formats an address (e.g. "Backups <backups@example.com>") for the headers, encoding its name if needed
+func header(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		return a.String()
+	}
+	return addr
+}
+
+// envelope returns the bare email of an address, for the SMTP envelope
+func envelope(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		return a.Address
+	}
+	return addr
+}
+
+// messageID returns a random ID for the Message-ID header
+func messageID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return strconv.FormatInt(time.Now().Unix(), 10) + "." + hex.EncodeToString(b)
+}
+
+// formatBytes formats a size in bytes for humans (e.g. "1.5 MiB")
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
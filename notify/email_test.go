@@ -0,0 +1,471 @@
+package notify
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+var (
+	testSince = time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	testUntil = time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+)
+
+func TestDefaultTemplates(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       Event
+		wantSubject string
+		want        []string
+		notWant     []string
+	}{
+		{
+			name: "failure",
+			event: Event{
+				Kind: EventFailure, Cluster: "dc1", Summary: "backup of dc1 failed", Result: "failure",
+				RunID: "r1", Trigger: "schedule", Duration: "2s", Error: "consul unreachable",
+				Outputs: []OutputEvent{{Name: "local", Status: "failed", Error: "disk full"}},
+			},
+			wantSubject: "[consul-snapshotter] backup of dc1 failed",
+			want: []string{
+				"backup of dc1 failed\n",
+				"Cluster:  dc1\n",
+				"Result:   failure\n",
+				"Run:      r1 (schedule, took 2s)\n",
+				"Error:    consul unreachable\n",
+				"  local: failed, 0 B saved, 0 deleted by retention\n    error: disk full\n",
+			},
+			notWant: []string{"Snapshot:", "Restored:", "Period:"},
+		},
+		{
+			name: "success",
+			event: Event{
+				Kind: EventSuccess, Cluster: "dc1", Summary: "backup of dc1 succeeded", Result: "success",
+				RunID: "r2", Trigger: "manual", Duration: "1s", Index: 42, Size: 1536,
+				Outputs: []OutputEvent{{Name: "local", Status: "saved", Bytes: 1536, Deleted: 2}},
+			},
+			wantSubject: "[consul-snapshotter] backup of dc1 succeeded",
+			want: []string{
+				"Snapshot: index 42, 1.5 KiB\n",
+				"  local: saved, 1.5 KiB saved, 2 deleted by retention\n",
+			},
+			notWant: []string{"Error:", "error:"},
+		},
+		{
+			name: "restore verified",
+			event: Event{
+				Kind: EventRestoreVerified, Cluster: "dc1", Summary: "restore of dc1 verified", Result: "success",
+				RunID: "r3", Trigger: "schedule", Duration: "10s",
+				Restore: &Restore{Output: "local", Snapshot: "dc1-42.snap", KVEntries: 3, Nodes: 1, Services: 2},
+			},
+			want: []string{
+				"Restored: dc1-42.snap, from local\n",
+				"Contents: 3 KV entries, 1 nodes, 2 services\n",
+			},
+			notWant: []string{"Outputs:"},
+		},
+		{
+			name: "digest",
+			event: Event{
+				Kind: EventDigest, Cluster: "dc1", Summary: "24 backups of dc1, 1 failed",
+				Digest: &Digest{Since: testSince, Until: testUntil, Runs: 24, Failed: 1, Outputs: []DigestOutput{
+					{Name: "local", Saved: 23, Failed: 1, Bytes: 3 << 20, LastSuccess: testUntil},
+					{Name: "azure", Failed: 24},
+				}},
+			},
+			want: []string{
+				"Period:  2026-10-18 00:00:00 UTC - 2026-10-19 00:00:00 UTC\n",
+				"Runs:    24 (1 failed)\n",
+				"  local: 23 saved, 1 failed, 3.0 MiB, last success: 2026-10-19 00:00:00 UTC\n",
+				"  azure: 0 saved, 24 failed, 0 B, last success: never\n",
+			},
+			notWant: []string{"Cluster:", "Run:"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject := render(t, DefaultSubject, tt.event)
+			if tt.wantSubject != "" && subject != tt.wantSubject {
+				t.Errorf("subject = %q, want %q", subject, tt.wantSubject)
+			}
+			body := render(t, DefaultBody, tt.event)
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("body = %q, want it to contain %q", body, want)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(body, s) {
+					t.Errorf("body = %q, want it not to contain %q", body, s)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	if _, err := ParseTemplate("subject", "{{.Summary"); err == nil {
+		t.Error("ParseTemplate() of an unclosed action succeeded")
+	}
+
+	got := render(t, "{{.Cluster}}: {{bytes .Size}}", Event{Cluster: "dc1", Size: 5 << 30})
+	if want := "dc1: 5.0 GiB"; got != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+
+	n := &Email{Address: "127.0.0.1:25", From: "backups@example.com", To: []string{"ops@example.com"}}
+	n.Subject = mustParse(t, DefaultSubject)
+	n.Body = mustParse(t, "{{.Nope}}")
+	if _, err := n.message(Event{}); err == nil || !strings.Contains(err.Error(), "error rendering the body") {
+		t.Errorf("message() error = %v, want one rendering the body", err)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{10 << 20, "10.0 MiB"},
+		{3 << 40, "3.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestEmailNotify(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *fakeSMTP
+		tls    string
+		// username authenticates as the fake server's user, with password
+		username, password string
+		// untrusted leaves the certificate of the server unverifiable
+		untrusted bool
+		to        []string
+		wantTLS   bool
+		wantErr   string
+	}{
+		{name: "starttls", server: &fakeSMTP{starttls: true, auth: true}, tls: TLSStartTLS, username: "backups", password: "s3cret", wantTLS: true},
+		{name: "tls", server: &fakeSMTP{implicit: true, auth: true}, tls: TLSImplicit, username: "backups", password: "s3cret", wantTLS: true},
+		{name: "none", server: &fakeSMTP{starttls: true}, tls: TLSNone},
+		{name: "none with auth to localhost", server: &fakeSMTP{auth: true}, tls: TLSNone, username: "backups", password: "s3cret"},
+		{name: "starttls not offered", server: &fakeSMTP{auth: true}, tls: TLSStartTLS, username: "backups", password: "s3cret", wantErr: "does not offer STARTTLS"},
+		{name: "auth not offered", server: &fakeSMTP{starttls: true}, tls: TLSStartTLS, username: "backups", password: "s3cret", wantErr: "does not offer authentication"},
+		{name: "wrong password", server: &fakeSMTP{implicit: true, auth: true}, tls: TLSImplicit, username: "backups", password: "wrong", wantErr: "authentication failed"},
+		{name: "untrusted certificate", server: &fakeSMTP{implicit: true}, tls: TLSImplicit, untrusted: true, wantErr: "certificate signed by unknown authority"},
+		{name: "untrusted certificate on starttls", server: &fakeSMTP{starttls: true}, tls: TLSStartTLS, untrusted: true, wantErr: "certificate signed by unknown authority"},
+		{name: "recipient rejected", server: &fakeSMTP{}, tls: TLSNone, to: []string{"nobody@example.com"}, wantErr: "recipient nobody@example.com: 550"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := tt.server
+			roots := srv.start(t)
+
+			n := &Email{
+				Address:  srv.ln.Addr().String(),
+				TLS:      tt.tls,
+				Username: tt.username,
+				Password: tt.password,
+				From:     "Backups <backups@example.com>",
+				To:       []string{"ops@example.com", "Zoë <zoe@example.com>"},
+				Subject:  mustParse(t, DefaultSubject),
+				Body:     mustParse(t, DefaultBody),
+				rootCAs:  roots,
+			}
+			if tt.to != nil {
+				n.To = tt.to
+			}
+			if tt.untrusted {
+				n.rootCAs = x509.NewCertPool()
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			err := n.Notify(ctx, Event{Kind: EventFailure, Cluster: "dc1", Summary: "backup of dc1 failed:\nconsul unreachable (é)", Result: "failure", Error: "consul unreachable"})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Notify() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				if msgs := srv.messages(); len(msgs) > 0 {
+					t.Errorf("the server received %d messages, want none", len(msgs))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Notify() error = %v", err)
+			}
+
+			msgs := srv.messages()
+			if len(msgs) != 1 {
+				t.Fatalf("the server received %d messages, want 1", len(msgs))
+			}
+			got := msgs[0]
+			if got.tls != tt.wantTLS {
+				t.Errorf("sent over TLS = %v, want %v", got.tls, tt.wantTLS)
+			}
+			if got.user != tt.username {
+				t.Errorf("authenticated as %q, want %q", got.user, tt.username)
+			}
+			if got.from != "backups@example.com" {
+				t.Errorf("envelope sender = %q, want backups@example.com", got.from)
+			}
+			if want := []string{"ops@example.com", "zoe@example.com"}; !slices.Equal(got.to, want) {
+				t.Errorf("envelope recipients = %q, want %q", got.to, want)
+			}
+			checkMessage(t, got.data)
+		})
+	}
+}
+
+func TestEmailNotifyCanceled(t *testing.T) {
+	// a server that never greets
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-done
+	}()
+
+	n := &Email{
+		Address: ln.Addr().String(),
+		TLS:     TLSNone,
+		From:    "backups@example.com",
+		To:      []string{"ops@example.com"},
+		Subject: mustParse(t, DefaultSubject),
+		Body:    mustParse(t, DefaultBody),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := n.Notify(ctx, Event{Summary: "backup failed"}); err == nil {
+		t.Fatal("Notify() succeeded, want a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Notify() gave up after %v, want it to give up with its context", elapsed)
+	}
+}
+
+// checkMessage checks the headers and the body of the email sent by TestEmailNotify
+func checkMessage(t *testing.T, data string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("error reading the message: %v", err)
+	}
+	if got, want := msg.Header.Get("From"), `"Backups" <backups@example.com>`; got != want {
+		t.Errorf("From = %q, want %q", got, want)
+	}
+	to, err := msg.Header.AddressList("To")
+	if err != nil || len(to) != 2 || to[1].Name != "Zoë" || to[1].Address != "zoe@example.com" {
+		t.Errorf("To = %q (%v), want ops@example.com and Zoë <zoe@example.com>", msg.Header.Get("To"), err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if want := "[consul-snapshotter] backup of dc1 failed: consul unreachable (é)"; err != nil || subject != want {
+		t.Errorf("Subject = %q (%v), want %q", subject, err, want)
+	}
+	if msg.Header.Get("Message-ID") == "" || msg.Header.Get("Date") == "" {
+		t.Error("the message has no Message-ID or Date")
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatalf("error decoding the body: %v", err)
+	}
+	if want := "Error:    consul unreachable\n"; !strings.Contains(string(body), want) {
+		t.Errorf("body = %q, want it to contain %q", body, want)
+	}
+}
+
+// fakeSMTP is an SMTP server, on a local port, that keeps the messages it receives
+type fakeSMTP struct {
+	// implicit serves over TLS from the start
+	implicit bool
+	// starttls and auth offer STARTTLS and PLAIN authentication, as backups:s3cret
+	starttls bool
+	auth     bool
+
+	ln        net.Listener
+	tlsConfig *tls.Config
+
+	mu   sync.Mutex
+	msgs []smtpMessage
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+	tls  bool
+	user string
+}
+
+// start serves until the end of the test, and returns the roots that verify the certificate of the server
+func (s *fakeSMTP) start(t *testing.T) *x509.CertPool {
+	t.Helper()
+	// the certificate of httptest is valid for 127.0.0.1
+	https := httptest.NewTLSServer(nil)
+	s.tlsConfig = &tls.Config{Certificates: https.TLS.Certificates}
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	https.Close()
+
+	var err error
+	if s.implicit {
+		s.ln, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.ln.Close() })
+	go func() {
+		for {
+			conn, err := s.ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return roots
+}
+
+func (s *fakeSMTP) messages() []smtpMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.msgs)
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	tp := textproto.NewConn(conn)
+	isTLS := s.implicit
+	var msg smtpMessage
+
+	tp.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			exts := []string{"fake"}
+			if s.starttls && !isTLS {
+				exts = append(exts, "STARTTLS")
+			}
+			if s.auth {
+				exts = append(exts, "AUTH PLAIN")
+			}
+			exts = append(exts, "8BITMIME")
+			for i, ext := range exts {
+				sep := "-"
+				if i == len(exts)-1 {
+					sep = " "
+				}
+				tp.PrintfLine("250%s%s", sep, ext)
+			}
+		case "STARTTLS":
+			tp.PrintfLine("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, tp, isTLS = tlsConn, textproto.NewConn(tlsConn), true
+		case "AUTH":
+			if !s.auth {
+				tp.PrintfLine("502 unknown command")
+				continue
+			}
+			_, resp, _ := strings.Cut(arg, " ")
+			creds, _ := base64.StdEncoding.DecodeString(resp)
+			if string(creds) != "\x00backups\x00s3cret" {
+				tp.PrintfLine("535 authentication failed")
+				continue
+			}
+			msg.user = "backups"
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(strings.Fields(arg)[0], "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			to := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if to == "nobody@example.com" {
+				tp.PrintfLine("550 no such user")
+				continue
+			}
+			msg.to = append(msg.to, to)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 end with .")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data, msg.tls = string(data), isTLS
+			s.mu.Lock()
+			s.msgs = append(s.msgs, msg)
+			s.mu.Unlock()
+			msg = smtpMessage{user: msg.user}
+			tp.PrintfLine("250 queued")
+		case "RSET", "NOOP":
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+func render(t *testing.T, text string, e Event) string {
+	t.Helper()
+	var b strings.Builder
+	if err := mustParse(t, text).Execute(&b, e); err != nil {
+		t.Fatalf("error rendering %q: %v", text, err)
+	}
+	return b.String()
+}
+
+func mustParse(t *testing.T, text string) *template.Template {
+	t.Helper()
+	tmpl, err := ParseTemplate("test", text)
+	if err != nil {
+		t.Fatalf("ParseTemplate(%q) error = %v", text, err)
+	}
+	return tmpl
+}
@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+// kinds of events
+const (
+	// EventFailure is sent after every run that failed
+	EventFailure = "failure"
+	// EventRecovered is sent after the first run that succeeded after a failed one
+	EventRecovered = "recovered"
+	// EventSuccess is sent after every run that succeeded
+	EventSuccess = "success"
+	// EventDigest is sent on a schedule, summing up the runs since the last one
+	EventDigest = "digest"
+	// EventRestoreFailed is sent after every restore verification that failed
+	EventRestoreFailed = "restore-failed"
+	// EventRestoreVerified is sent after every restore verification that succeeded
+	EventRestoreVerified = "restore-verified"
+)
+
+// Events are the kinds of events, in the order they are documented
+var Events = []string{EventFailure, EventRecovered, EventSuccess, EventDigest, EventRestoreFailed, EventRestoreVerified}
+
+// Event is what a notification is about: a run, or a digest of the runs
+type Event struct {
+	Kind    string `json:"event"`
+	Cluster string `json:"cluster"`
+	Summary string `json:"summary"`
+
+	// the run, for all the events but digests
+	RunID     string    `json:"run-id,omitempty"`
+	Trigger   string    `json:"trigger,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started-at,omitzero"`
+	Duration  string    `json:"duration,omitempty"`
+	// Index and Size describe the snapshot, once it is taken
+	Index   uint64        `json:"index,omitempty"`
+	Size    int64         `json:"size,omitempty"`
+	Outputs []OutputEvent `json:"outputs,omitempty"`
+
+	Digest *Digest `json:"digest,omitempty"`
+	// Restore is the snapshot restored by a restore verification, for its events
+	Restore *Restore `json:"restore,omitempty"`
+}
+
+// OutputEvent is the result of an output in a run
+type OutputEvent struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Bytes  int64  `json:"bytes"`
+	// Deleted is the number of snapshots removed by the retention policy
+	Deleted int    `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Digest sums up the runs between Since and Until
+type Digest struct {
+	Since   time.Time      `json:"since"`
+	Until   time.Time      `json:"until"`
+	Runs    int            `json:"runs"`
+	Failed  int            `json:"failed"`
+	Outputs []DigestOutput `json:"outputs"`
+}
+
+// DigestOutput sums up the results of an output
+type DigestOutput struct {
+	Name        string    `json:"name"`
+	Saved       int       `json:"saved"`
+	Failed      int       `json:"failed"`
+	Bytes       int64     `json:"bytes"`
+	LastSuccess time.Time `json:"last-success,omitzero"`
+}
+
+// Restore describes the snapshot restored by a restore verification, and what the restored cluster held
+type Restore struct {
+	Output    string `json:"output"`
+	Snapshot  string `json:"snapshot"`
+	KVEntries int    `json:"kv-entries"`
+	Nodes     int    `json:"nodes"`
+	Services  int    `json:"services"`
+}
+
+// Failed reports whether the event is about a failure
+func (e Event) Failed() bool {
+	return e.Kind == EventFailure || e.Kind == EventRestoreFailed || (e.Digest != nil && e.Digest.Failed > 0)
+}
+
+// Notifier sends notifications to a destination
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+}
+
+// postJSON posts body, encoded as JSON, to url, failing on any status but 2xx
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// leave out the URL, which may hold a secret (e.g. of Slack webhooks)
+		var urlErr *neturl.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("error sending the notification: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("notification rejected with status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// PagerDutyURL is the endpoint of the PagerDuty Events API v2
+const PagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty triggers an alert on failures, and resolves it on successes, through the Events API v2.
+// The alerts of a cluster share the same dedup key, so that repeated failures update a single alert,
+// and the ones of its restore verifications another one.
+type PagerDuty struct {
+	// URL defaults to PagerDutyURL
+	URL        string
+	RoutingKey string
+	Client     *http.Client
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string `json:"summary"`
+	Source        string `json:"source"`
+	Severity      string `json:"severity"`
+	Component     string `json:"component"`
+	CustomDetails Event  `json:"custom_details"`
+}
+
+func (n *PagerDuty) Notify(ctx context.Context, e Event) error {
+	if e.Digest != nil {
+		return errors.New("digests cannot be sent to PagerDuty")
+	}
+
+	url := n.URL
+	if url == "" {
+		url = PagerDutyURL
+	}
+
+	pe := pagerDutyEvent{
+		RoutingKey:  n.RoutingKey,
+		EventAction: "resolve",
+		DedupKey:    "consul-snapshotter/" + e.Cluster,
+	}
+	if e.Restore != nil {
+		pe.DedupKey += "/restore"
+	}
+	if e.Failed() {
+		pe.EventAction = "trigger"
+		pe.Payload = &pagerDutyPayload{
+			Summary:       e.Summary,
+			Source:        e.Cluster,
+			Severity:      "error",
+			Component:     "consul-snapshotter",
+			CustomDetails: e,
+		}
+	}
+	return postJSON(ctx, n.Client, url, nil, pe)
+}
@@ -0,0 +1,97 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Slack posts the events to a Slack incoming webhook
+type Slack struct {
+	URL    string
+	Client *http.Client
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Fields []slackField `json:"fields"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func (n *Slack) Notify(ctx context.Context, e Event) error {
+	color := "good"
+	if e.Failed() {
+		color = "danger"
+	}
+
+	var fields []slackField
+	for _, f := range facts(e) {
+		fields = append(fields, slackField{Title: f.title, Value: f.value, Short: len(f.value) < 40})
+	}
+
+	msg := slackMessage{
+		Text:        e.Summary,
+		Attachments: []slackAttachment{{Color: color, Fields: fields}},
+	}
+	return postJSON(ctx, n.Client, n.URL, nil, msg)
+}
+
+// fact is a titled value describing an event, in the messages of the chat notifiers
+type fact struct {
+	title string
+	value string
+}
+
+// facts describes the event for humans: the run and the result of each output, or the digest
+func facts(e Event) []fact {
+	if d := e.Digest; d != nil {
+		f := []fact{
+			{"Runs", fmt.Sprintf("%d (%d failed)", d.Runs, d.Failed)},
+			{"Period", fmt.Sprintf("%s - %s", d.Since.Format(time.RFC3339), d.Until.Format(time.RFC3339))},
+		}
+		for _, o := range d.Outputs {
+			last := "never"
+			if !o.LastSuccess.IsZero() {
+				last = o.LastSuccess.Format(time.RFC3339)
+			}
+			f = append(f, fact{o.Name, fmt.Sprintf("%d saved, %d failed, last success: %s", o.Saved, o.Failed, last)})
+		}
+		return f
+	}
+
+	f := []fact{
+		{"Result", e.Result},
+		{"Run", fmt.Sprintf("%s (%s, took %s)", e.RunID, e.Trigger, e.Duration)},
+	}
+	if e.Index > 0 {
+		f = append(f, fact{"Snapshot", fmt.Sprintf("index %d, %d bytes", e.Index, e.Size)})
+	}
+	if r := e.Restore; r != nil {
+		f = append(f,
+			fact{"Restored", fmt.Sprintf("%s, from %s", r.Snapshot, r.Output)},
+			fact{"Contents", fmt.Sprintf("%d KV entries, %d nodes, %d services", r.KVEntries, r.Nodes, r.Services)},
+		)
+	}
+	for _, o := range e.Outputs {
+		value := o.Status
+		if o.Error != "" {
+			value += ": " + o.Error
+		}
+		f = append(f, fact{o.Name, value})
+	}
+	if e.Error != "" && len(e.Outputs) == 0 {
+		f = append(f, fact{"Error", e.Error})
+	}
+	return f
+}
@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+)
+
+// Teams posts the events to a Microsoft Teams webhook (a Workflows or an incoming webhook), as Adaptive Cards
+type Teams struct {
+	URL    string
+	Client *http.Client
+}
+
+type teamsMessage struct {
+	Type        string            `json:"type"`
+	Attachments []teamsAttachment `json:"attachments"`
+}
+
+type teamsAttachment struct {
+	ContentType string    `json:"contentType"`
+	Content     teamsCard `json:"content"`
+}
+
+type teamsCard struct {
+	Schema  string        `json:"$schema"`
+	Type    string        `json:"type"`
+	Version string        `json:"version"`
+	Body    []interface{} `json:"body"`
+}
+
+type teamsTextBlock struct {
+	Type   string `json:"type"`
+	Text   string `json:"text"`
+	Weight string `json:"weight,omitempty"`
+	Color  string `json:"color,omitempty"`
+	Wrap   bool   `json:"wrap"`
+}
+
+type teamsFactSet struct {
+	Type  string      `json:"type"`
+	Facts []teamsFact `json:"facts"`
+}
+
+type teamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+func (n *Teams) Notify(ctx context.Context, e Event) error {
+	color := "Good"
+	if e.Failed() {
+		color = "Attention"
+	}
+
+	var teamsFacts []teamsFact
+	for _, f := range facts(e) {
+		teamsFacts = append(teamsFacts, teamsFact{Title: f.title, Value: f.value})
+	}
+
+	msg := teamsMessage{
+		Type: "message",
+		Attachments: []teamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content: teamsCard{
+				Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+				Type:    "AdaptiveCard",
+				Version: "1.4",
+				Body: []interface{}{
+					teamsTextBlock{Type: "TextBlock", Text: e.Summary, Weight: "Bolder", Color: color, Wrap: true},
+					teamsFactSet{Type: "FactSet", Facts: teamsFacts},
+				},
+			},
+		}},
+	}
+	return postJSON(ctx, n.Client, n.URL, nil, msg)
+}
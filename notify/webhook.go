@@ -0,0 +1,22 @@
+package notify
+
+import (
+	"context"
+	"net/http"
+)
+
+// Webhook posts the events as they are, encoded as JSON
+type Webhook struct {
+	URL string
+	// Authorization is the value of the Authorization header, if any (e.g. "Bearer <token>")
+	Authorization string
+	Client        *http.Client
+}
+
+func (n *Webhook) Notify(ctx context.Context, e Event) error {
+	headers := map[string]string{}
+	if n.Authorization != "" {
+		headers["Authorization"] = n.Authorization
+	}
+	return postJSON(ctx, n.Client, n.URL, headers, e)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+
+	"github.com/ruizink/consul-snapshotter/notify"
+)
+
+// the notifier types
+const (
+	notifierTypeWebhook   = "webhook"
+	notifierTypeSlack     = "slack"
+	notifierTypeTeams     = "teams"
+	notifierTypePagerDuty = "pagerduty"
+	notifierTypeSMTP      = "smtp"
+)
+
+var notifierTypes = []string{notifierTypeWebhook, notifierTypeSlack, notifierTypeTeams, notifierTypePagerDuty, notifierTypeSMTP}
+
+// the default ports of the SMTP servers, by TLS mode
+var smtpPorts = map[string]int{
+	notify.TLSStartTLS: 587,
+	notify.TLSImplicit: 465,
+	notify.TLSNone:     25,
+}
+
+// defaultNotifierEvents are the events a notifier is sent when it does not set any
+var defaultNotifierEvents = []string{notify.EventFailure, notify.EventRecovered, notify.EventRestoreFailed}
+
+type notificationsConfig struct {
+	Timeout        time.Duration `json:"timeout"`
+	DigestSchedule string        `json:"digest-schedule"`
+}
+
+// notifierConfig is a named notifier, sent the events it is interested in
+type notifierConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// URL is the webhook to post to (optional for PagerDuty)
+	URL     string `json:"url" secret:"true"`
+	URLFile string `json:"url-file"`
+	// Authorization is the Authorization header of generic webhooks
+	Authorization     string `json:"authorization" secret:"true"`
+	AuthorizationFile string `json:"authorization-file"`
+	// RoutingKey is the integration key of PagerDuty
+	RoutingKey     string `json:"routing-key" secret:"true"`
+	RoutingKeyFile string `json:"routing-key-file"`
+	// the SMTP server to send emails through, and the emails
+	Host         string   `json:"host"`
+	Port         int      `json:"port"`
+	TLS          string   `json:"tls"`
+	Username     string   `json:"username"`
+	Password     string   `json:"password" secret:"true"`
+	PasswordFile string   `json:"password-file"`
+	From         string   `json:"from"`
+	To           []string `json:"to"`
+	Subject      string   `json:"subject"`
+	Body         string   `json:"body"`
+	Events       []string `json:"events"`
+
+	// settings of the notifier that it does not have
+	unknownKeys []string
+	// settings of the notifier that could not be read
+	invalidSettings []error
+}
+
+// readNotifiersConfig reads the notifiers list, each one with its own settings:
+//
+//	notifiers:
+//	  - name: oncall
+//	    type: pagerduty
+//	    routing-key-file: /run/secrets/pagerduty-key
+//	    events: [failure, recovered]
+func readNotifiersConfig(v *viper.Viper) ([]notifierConfig, error) {
+	var entries []interface{}
+	switch notifiers := v.Get("notifiers").(type) {
+	case []interface{}:
+		entries = notifiers
+	case nil:
+	default:
+		return nil, fmt.Errorf("notifiers: expected a list, got %T", notifiers)
+	}
+
+	var notifiers []notifierConfig
+	for i, entry := range entries {
+		settings, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("notifiers.%d: expected a notifier with name and type, got %T", i, entry)
+		}
+		notifiers = append(notifiers, newNotifierConfig(settings))
+	}
+	return notifiers, nil
+}
+
+func newNotifierConfig(settings map[string]interface{}) notifierConfig {
+	iv := viper.New()
+	iv.MergeConfigMap(settings)
+
+	nc := notifierConfig{
+		Name:              iv.GetString("name"),
+		Type:              iv.GetString("type"),
+		URL:               iv.GetString("url"),
+		URLFile:           iv.GetString("url-file"),
+		Authorization:     iv.GetString("authorization"),
+		AuthorizationFile: iv.GetString("authorization-file"),
+		RoutingKey:        iv.GetString("routing-key"),
+		RoutingKeyFile:    iv.GetString("routing-key-file"),
+		Host:              iv.GetString("host"),
+		Port:              iv.GetInt("port"),
+		TLS:               iv.GetString("tls"),
+		Username:          iv.GetString("username"),
+		Password:          iv.GetString("password"),
+		PasswordFile:      iv.GetString("password-file"),
+		From:              iv.GetString("from"),
+		Subject:           iv.GetString("subject"),
+		Body:              iv.GetString("body"),
+		Events:            defaultNotifierEvents,
+	}
+	if nc.Type == notifierTypeSMTP {
+		if nc.TLS == "" {
+			nc.TLS = notify.TLSStartTLS
+		}
+		if nc.Port == 0 {
+			nc.Port = smtpPorts[nc.TLS]
+		}
+		if nc.Subject == "" {
+			nc.Subject = notify.DefaultSubject
+		}
+		if nc.Body == "" {
+			nc.Body = notify.DefaultBody
+		}
+	}
+	if nc.Name == "" {
+		nc.Name = nc.Type
+	}
+	if events, ok := settings["events"]; ok {
+		var err error
+		if nc.Events, err = cast.ToStringSliceE(events); err != nil {
+			nc.invalidSettings = append(nc.invalidSettings, fmt.Errorf("events: expected a list, got %q", fmt.Sprint(events)))
+		}
+	}
+	if to, ok := settings["to"]; ok {
+		var err error
+		if nc.To, err = cast.ToStringSliceE(to); err != nil {
+			nc.invalidSettings = append(nc.invalidSettings, fmt.Errorf("to: expected a list, got %q", fmt.Sprint(to)))
+		}
+	}
+
+	for key := range settings {
+		if !hasJSONField(reflect.TypeOf(nc), key) {
+			nc.unknownKeys = append(nc.unknownKeys, key)
+		}
+	}
+	sort.Strings(nc.unknownKeys)
+
+	return nc
+}
+
+// wants reports whether the notifier is sent the events of the given kind
+func (nc *notifierConfig) wants(kind string) bool {
+	return slices.Contains(nc.Events, kind)
+}
+
+// validate lists the problems of the notifier, through problem
+func (nc *notifierConfig) validate(key string, problem func(format string, a ...interface{})) {
+	switch {
+	case nc.Type == "":
+		problem("%s: type is required (valid types: %s)", key, strings.Join(notifierTypes, ", "))
+		return
+	case !slices.Contains(notifierTypes, nc.Type):
+		problem("%s: unknown type %q (valid types: %s)", key, nc.Type, strings.Join(notifierTypes, ", "))
+		return
+	}
+	for _, k := range nc.unknownKeys {
+		problem("%s: unknown setting %q for notifier type %q", key, k, nc.Type)
+	}
+	for _, err := range nc.invalidSettings {
+		problem("%s: %v", key, err)
+	}
+
+	switch {
+	case nc.Type == notifierTypeSMTP:
+		if nc.URL != "" {
+			problem("%s: url is not used by smtp (set host instead)", key)
+		}
+		nc.validateSMTP(key, problem)
+	case nc.Type != notifierTypePagerDuty && nc.URL == "":
+		problem("%s: url must be set", key)
+	case nc.URL != "" && !validHTTPURL(nc.URL):
+		problem("%s: url must be an http or https URL", key)
+	}
+	if nc.Type != notifierTypeSMTP {
+		for _, s := range nc.smtpSettings() {
+			problem("%s: %s is only used by smtp", key, s)
+		}
+	}
+	if nc.Type == notifierTypePagerDuty && nc.RoutingKey == "" {
+		problem("%s: routing-key must be set", key)
+	}
+	if nc.Type != notifierTypePagerDuty && nc.RoutingKey != "" {
+		problem("%s: routing-key is only used by pagerduty", key)
+	}
+	if nc.Type != notifierTypeWebhook && nc.Authorization != "" {
+		problem("%s: authorization is only used by webhook", key)
+	}
+
+	if len(nc.Events) == 0 {
+		problem("%s: events must not be empty", key)
+	}
+	for _, event := range nc.Events {
+		if !slices.Contains(notify.Events, event) {
+			problem("%s: unknown event %q (valid events: %s)", key, event, strings.Join(notify.Events, ", "))
+		}
+	}
+	if nc.Type == notifierTypePagerDuty && nc.wants(notify.EventDigest) {
+		problem("%s: pagerduty cannot be sent digests", key)
+	}
+}
+
+// validateSMTP lists the problems of the SMTP settings of the notifier, through problem
+func (nc *notifierConfig) validateSMTP(key string, problem func(format string, a ...interface{})) {
+	if nc.Host == "" {
+		problem("%s: host must be set", key)
+	}
+	if nc.Port < 1 || nc.Port > 65535 {
+		problem("%s: port must be between 1 and 65535", key)
+	}
+	if !slices.Contains(notify.TLSModes, nc.TLS) {
+		problem("%s: unknown tls mode %q (valid modes: %s)", key, nc.TLS, strings.Join(notify.TLSModes, ", "))
+	}
+	if nc.Password != "" && nc.Username == "" {
+		problem("%s: password is set without a username", key)
+	}
+
+	if nc.From == "" {
+		problem("%s: from must be set", key)
+	} else if _, err := mail.ParseAddress(nc.From); err != nil {
+		problem("%s: from: invalid address %q: %v", key, nc.From, err)
+	}
+	if len(nc.To) == 0 {
+		problem("%s: to must list at least one recipient", key)
+	}
+	for _, to := range nc.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			problem("%s: to: invalid address %q: %v", key, to, err)
+		}
+	}
+
+	if _, err := notify.ParseTemplate("subject", nc.Subject); err != nil {
+		problem("%s: subject: %v", key, err)
+	}
+	if _, err := notify.ParseTemplate("body", nc.Body); err != nil {
+		problem("%s: body: %v", key, err)
+	}
+}
+
+// smtpSettings returns the SMTP settings that are set
+func (nc *notifierConfig) smtpSettings() []string {
+	var set []string
+	for _, s := range []struct {
+		name  string
+		isSet bool
+	}{
+		{"host", nc.Host != ""},
+		{"port", nc.Port != 0},
+		{"tls", nc.TLS != ""},
+		{"username", nc.Username != ""},
+		{"password", nc.Password != ""},
+		{"from", nc.From != ""},
+		{"to", len(nc.To) > 0},
+		{"subject", nc.Subject != ""},
+		{"body", nc.Body != ""},
+	} {
+		if s.isSet {
+			set = append(set, s.name)
+		}
+	}
+	return set
+}
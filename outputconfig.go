@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+
+	"github.com/ruizink/consul-snapshotter/outputs"
+)
+
+// the output types, with the config block their settings default to
+const (
+	outputTypeLocal     = "local"
+	outputTypeAzureBlob = "azure_blob"
+)
+
+var outputTypeBlocks = map[string]string{
+	outputTypeLocal:     "local",
+	outputTypeAzureBlob: "azure-blob",
+}
+
+// credentialSettings are the settings of each output type that authenticate it. An output that sets any of them
+// does not inherit the others from the block of its type, so that its credentials never mix with the inherited ones.
+var credentialSettings = map[string][]string{
+	outputTypeAzureBlob: {"storage-access-key", "storage-access-key-file", "storage-sas-token", "storage-sas-token-file"},
+}
+
+// outputNameRegexp restricts output names to what can safely go in a file name
+var outputNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// outputConfig is a named instance of an output type.
+// Only the settings of its type are set, and they are inlined with name and type.
+type outputConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Required outputs fail the run when they fail, while best-effort ones only get it to warn
+	Required bool `json:"required"`
+
+	Local     *localOutputConfig `json:"local,inline"`
+	AzureBlob *azureOutputConfig `json:"azure-blob,inline"`
+
+	// Retry defaults to the top-level retry policy
+	Retry retryConfig `json:"retry"`
+	// Bandwidth limits the output on its own, besides the top-level limit shared by all the outputs
+	Bandwidth bandwidthConfig `json:"bandwidth"`
+
+	// settings of the instance that its type does not have
+	unknownKeys []string
+	// settings of the instance that could not be read
+	invalidSettings []error
+}
+
+// readOutputsConfig reads the outputs list. Each entry is either the name of an output type (e.g. "local"),
+// configured by the block of its type (e.g. "local:"), or a named instance of an output type with its own settings,
+// which default to the ones in the block of its type, its own retry policy, which defaults to the top-level one,
+// and its own bandwidth limit:
+//
+//	outputs:
+//	  - name: geo
+//	    type: azure_blob
+//	    storage-account: geoaccount
+//	    retention-period: 720h
+//	    retry:
+//	      max-attempts: 5
+//	    bandwidth:
+//	      limit: 5MiB
+func readOutputsConfig(v *viper.Viper) ([]outputConfig, error) {
+	var entries []interface{}
+	switch outputs := v.Get("outputs").(type) {
+	case []interface{}:
+		entries = outputs
+	case []string:
+		for _, output := range outputs {
+			entries = append(entries, output)
+		}
+	case string:
+		for _, output := range strings.Split(outputs, ",") {
+			entries = append(entries, strings.TrimSpace(output))
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("outputs: expected a list, got %T", outputs)
+	}
+
+	var outputs []outputConfig
+	for i, entry := range entries {
+		switch entry := entry.(type) {
+		case string:
+			outputs = append(outputs, newOutputConfig(v, entry, entry, nil))
+		case map[string]interface{}:
+			name, _ := entry["name"].(string)
+			outputType, _ := entry["type"].(string)
+			if name == "" {
+				name = outputType
+			}
+			delete(entry, "name")
+			delete(entry, "type")
+			outputs = append(outputs, newOutputConfig(v, name, outputType, entry))
+		default:
+			return nil, fmt.Errorf("outputs.%d: expected an output type or an output with name and type, got %T", i, entry)
+		}
+	}
+
+	return outputs, nil
+}
+
+// newOutputConfig builds the output instance from the settings in the block of its type, overridden by the given ones
+func newOutputConfig(v *viper.Viper, name, outputType string, settings map[string]interface{}) outputConfig {
+	oc := outputConfig{Name: name, Type: outputType, Required: true, Retry: readRetryConfig(v, "retry.")}
+	if required, ok := settings["required"]; ok {
+		var err error
+		if oc.Required, err = cast.ToBoolE(required); err != nil {
+			oc.invalidSettings = append(oc.invalidSettings, fmt.Errorf("required: expected a boolean, got %q", fmt.Sprint(required)))
+		}
+		delete(settings, "required")
+	}
+
+	block, ok := outputTypeBlocks[outputType]
+	if !ok {
+		return oc
+	}
+
+	ownCredentials := false
+	for _, setting := range credentialSettings[outputType] {
+		if _, ok := settings[setting]; ok {
+			ownCredentials = true
+		}
+	}
+
+	iv := viper.New()
+	for _, key := range v.AllKeys() {
+		if setting, found := strings.CutPrefix(key, block+"."); found {
+			if ownCredentials && slices.Contains(credentialSettings[outputType], setting) {
+				continue
+			}
+			iv.SetDefault(setting, v.Get(key))
+		}
+		if strings.HasPrefix(key, "retry.") {
+			iv.SetDefault(key, v.Get(key))
+		}
+	}
+	iv.MergeConfigMap(settings)
+	oc.Retry = readRetryConfig(iv, "retry.")
+	oc.Bandwidth = readBandwidthConfig(iv, "bandwidth.")
+
+	switch outputType {
+	case outputTypeLocal:
+		lc := readLocalOutputConfig(iv, "")
+		oc.Local = &lc
+	case outputTypeAzureBlob:
+		ac := readAzureOutputConfig(iv, "")
+		oc.AzureBlob = &ac
+	}
+
+	for key := range settings {
+		if key != "retry" && key != "bandwidth" && !hasJSONField(reflect.TypeOf(oc.settings()).Elem(), key) {
+			oc.unknownKeys = append(oc.unknownKeys, key)
+		}
+	}
+	sort.Strings(oc.unknownKeys)
+
+	return oc
+}
+
+// layout returns the layout of the snapshots in the output
+func (oc *outputConfig) layout() string {
+	switch {
+	case oc.Local != nil:
+		return oc.Local.Layout
+	case oc.AzureBlob != nil:
+		return oc.AzureBlob.Layout
+	}
+	return outputs.LayoutFlat
+}
+
+// retentionPeriod returns the retention period of the snapshots in the output
+func (oc *outputConfig) retentionPeriod() time.Duration {
+	switch {
+	case oc.Local != nil:
+		return oc.Local.RetentionPeriod
+	case oc.AzureBlob != nil:
+		return oc.AzureBlob.RetentionPeriod
+	}
+	return 0
+}
+
+// settings returns the settings of the output type
+func (oc *outputConfig) settings() interface{} {
+	switch {
+	case oc.Local != nil:
+		return oc.Local
+	case oc.AzureBlob != nil:
+		return oc.AzureBlob
+	}
+	return nil
+}
+
+// hasJSONField reports whether the struct type t has a field with the given json name
+func hasJSONField(t reflect.Type, name string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); tag == name {
+			return true
+		}
+	}
+	return false
+}
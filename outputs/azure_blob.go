@@ -1,57 +1,143 @@
 package outputs
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/ruizink/consul-snapshotter/azure"
 	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/throttle"
+	"github.com/ruizink/consul-snapshotter/tracing"
 )
 
 type AzureBlobOutput struct {
+	Name            string
 	AzureConfig     *azure.AzureConfig
 	RetentionPeriod time.Duration
+	Match           Matcher
+	// Limiters bound the bytes per second uploaded to the container
+	Limiters []*throttle.Limiter
 }
 
-func (o *AzureBlobOutput) Save(snap string) error {
-	az, err := azure.NewAzure(o.AzureConfig)
+func (o *AzureBlobOutput) Save(ctx context.Context, snap string) (int64, error) {
+	az, err := azure.NewAzure(ctx, o.AzureConfig)
 	if err != nil {
-		return fmt.Errorf("invalid azure config: %v", err)
+		return 0, fmt.Errorf("invalid azure config: %v", err)
+	}
+	var n int64
+	if len(o.Limiters) > 0 {
+		n, err = o.uploadLimited(ctx, az, snap)
+	} else {
+		n, err = az.UploadBlob(ctx, snap)
 	}
-	err = az.UploadBlob(snap)
 	if err != nil {
-		return fmt.Errorf("error uploading snapshot file: %v", err)
+		return 0, fmt.Errorf("error uploading snapshot file: %w", err)
 	}
-	// logger.Info("Uploaded snapshot to: ", destFile)
-	return nil
+	logger.FromContext(ctx).Info(fmt.Sprintf("Uploaded snapshot to: %s/%s%s", o.AzureConfig.ContainerName, az.BlobPrefix(), o.AzureConfig.Filename))
+	return n, nil
 }
 
-func (o *AzureBlobOutput) ApplyRetentionPolicy() error {
+// uploadLimited streams snap to the container, no faster than the limiters allow
+func (o *AzureBlobOutput) uploadLimited(ctx context.Context, az *azure.Azure, snap string) (int64, error) {
+	file, err := os.Open(snap)
+	if err != nil {
+		return 0, fmt.Errorf("error opening file: %w", err)
+	}
+	defer file.Close()
+	return az.UploadBlobStream(ctx, throttle.NewReader(ctx, file, o.Limiters...))
+}
+
+func (o *AzureBlobOutput) ApplyRetentionPolicy(ctx context.Context) (int, error) {
 	var errors error
+	removed := 0
 
 	if o.RetentionPeriod <= 0 {
-		return nil
+		return 0, nil
 	}
 
-	logger.Info(fmt.Sprintf("Applying Azure Blob Storage retention policy (remove blobs older than %v)", o.RetentionPeriod))
+	log := logger.FromContext(ctx)
+	log.Info(fmt.Sprintf("Applying Azure Blob Storage retention policy (remove snapshots older than %v)", o.RetentionPeriod))
 
-	azure, err := azure.NewAzure(o.AzureConfig)
+	az, err := azure.NewAzure(ctx, o.AzureConfig)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	blobList, _ := azure.ListBlobsOlderThan(o.RetentionPeriod)
+	snapshots, err := o.list(ctx, az)
+	if err != nil {
+		return 0, err
+	}
+	blobs := olderThan(snapshots, o.RetentionPeriod)
 
-	if len(blobList) > 0 {
-		logger.Info("List of Azure Blobs to remove:")
-		for _, blob := range blobList {
-			logger.Info(*blob.Name)
-			if err := azure.DeleteBlob(blob); err != nil {
+	if len(blobs) > 0 {
+		log.Info("List of Azure Blobs to remove:")
+		for _, blob := range blobs {
+			name := az.BlobPrefix() + blob.Name
+			log.Info(name)
+			deleteCtx, span := tracing.Start(ctx, "retention.delete", tracing.AttrSnapshot.String(name))
+			err := az.DeleteBlob(deleteCtx, name)
+			tracing.End(span, err)
+			if err != nil {
 				errors = multierror.Append(errors, err)
+				continue
 			}
+			removed++
 		}
 	}
 
-	return errors
+	return removed, errors
+}
+
+// List returns the snapshots of the output, found anywhere under the container path
+func (o *AzureBlobOutput) List(ctx context.Context) ([]Snapshot, error) {
+	az, err := azure.NewAzure(ctx, o.AzureConfig)
+	if err != nil {
+		return nil, err
+	}
+	return o.list(ctx, az)
+}
+
+// Open downloads the snapshot name, relative to the container path
+func (o *AzureBlobOutput) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	az, err := azure.NewAzure(ctx, o.AzureConfig)
+	if err != nil {
+		return nil, err
+	}
+	body, err := az.DownloadBlob(ctx, az.BlobPrefix()+name)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading blob: %w", err)
+	}
+	return body, nil
+}
+
+func (o *AzureBlobOutput) list(ctx context.Context, az *azure.Azure) ([]Snapshot, error) {
+	blobList, err := az.ListBlobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error listing blobs: %w", err)
+	}
+
+	// only keep the snapshots of this output
+	var snapshots []Snapshot
+	for _, blob := range blobList {
+		name := strings.TrimPrefix(*blob.Name, az.BlobPrefix())
+		if !o.Match(name) {
+			continue
+		}
+		s := Snapshot{Name: name}
+		if blob.Properties != nil {
+			if blob.Properties.ContentLength != nil {
+				s.Size = *blob.Properties.ContentLength
+			}
+			if blob.Properties.LastModified != nil {
+				s.ModTime = *blob.Properties.LastModified
+			}
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, nil
 }
@@ -0,0 +1,48 @@
+package outputs
+
+import (
+	"path"
+	"regexp"
+	"time"
+)
+
+// layouts of the snapshots under the root of an output
+const (
+	// LayoutFlat saves the snapshots as they are named
+	LayoutFlat = "flat"
+	// LayoutDate saves the snapshots in a directory per day, as YYYY/MM/DD/<name>
+	LayoutDate = "date"
+)
+
+// datePartition matches the directories of LayoutDate
+var datePartition = regexp.MustCompile(`^[0-9]{4}/[0-9]{2}/[0-9]{2}/`)
+
+// LayoutPath returns the path, relative to the root of an output, of the snapshot named name and taken at t
+func LayoutPath(layout, name string, t time.Time) string {
+	if layout == LayoutDate {
+		return path.Join(t.Format("2006/01/02"), name)
+	}
+	return name
+}
+
+// WithLayouts returns a Matcher that matches the snapshots of match, either saved as they are named
+// or partitioned by date, so that the snapshots saved before the layout changed are still found
+func WithLayouts(match Matcher) Matcher {
+	return func(name string) bool {
+		if match(name) {
+			return true
+		}
+		if trimmed, ok := TrimDatePartition(name); ok {
+			return match(trimmed)
+		}
+		return false
+	}
+}
+
+// TrimDatePartition returns path without its YYYY/MM/DD/ directories, and whether it had them
+func TrimDatePartition(path string) (string, bool) {
+	if loc := datePartition.FindStringIndex(path); loc != nil {
+		return path[loc[1]:], true
+	}
+	return path, false
+}
@@ -1,90 +1,176 @@
 package outputs
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
-	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/throttle"
+	"github.com/ruizink/consul-snapshotter/tracing"
 )
 
 type LocalOutput struct {
+	Name              string
 	DestinationPath   string
 	Filename          string
 	CreateDestination bool
 	RetentionPeriod   time.Duration
+	Match             Matcher
+	// Limiters bound the bytes per second written to the destination
+	Limiters []*throttle.Limiter
 }
 
-func (o *LocalOutput) Save(snap string) error {
-	// create destination dir if it doesn't exist
-	if o.CreateDestination {
-		if _, err := os.Stat(o.DestinationPath); errors.Is(err, os.ErrNotExist) {
-			err := os.Mkdir(o.DestinationPath, os.ModePerm)
-			if err != nil {
-				return err
-			}
+func (o *LocalOutput) Save(ctx context.Context, snap string) (int64, error) {
+	// create destination dir if it doesn't exist, if allowed to (e.g. not when it is a volume that may not be mounted)
+	if _, err := os.Stat(o.DestinationPath); errors.Is(err, os.ErrNotExist) {
+		if !o.CreateDestination {
+			return 0, fmt.Errorf("destination %s does not exist, and create-destination is disabled", o.DestinationPath)
+		}
+		err := os.Mkdir(o.DestinationPath, os.ModePerm)
+		if err != nil {
+			return 0, err
 		}
 	}
-	dstFile := path.Join(o.DestinationPath, o.Filename)
+	dstFile := filepath.Join(o.DestinationPath, filepath.FromSlash(o.Filename))
 
-	//Read all the contents of the  original file
-	bytesRead, err := os.ReadFile(snap)
-	if err != nil {
-		return err
+	// the file name may hold directories under the destination, created on demand
+	if err := os.MkdirAll(filepath.Dir(dstFile), os.ModePerm); err != nil {
+		return 0, err
 	}
 
-	//Copy all the contents to the desitination file
-	err = os.WriteFile(dstFile, bytesRead, 0644)
+	// copy the snapshot to the destination file
+	n, err := copyFile(ctx, snap, dstFile, o.Limiters...)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	logger.Info("Saved snapshot to: ", dstFile)
-	return nil
+	logger.FromContext(ctx).Info("Saved snapshot to: ", dstFile)
+	return n, nil
 }
 
-func (o *LocalOutput) ApplyRetentionPolicy() error {
+func (o *LocalOutput) ApplyRetentionPolicy(ctx context.Context) (int, error) {
 	var errors error
+	removed := 0
 
 	if o.RetentionPeriod <= 0 {
-		return nil
+		return 0, nil
 	}
 
-	logger.Info(fmt.Sprintf("Applying local retention policy (remove files older than %v)", o.RetentionPeriod))
-	files, err := findFilesOlderThan(o.DestinationPath, o.RetentionPeriod)
+	log := logger.FromContext(ctx)
+	log.Info(fmt.Sprintf("Applying local retention policy (remove snapshots older than %v)", o.RetentionPeriod))
+	snapshots, err := o.List(ctx)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	files := olderThan(snapshots, o.RetentionPeriod)
 
 	if len(files) > 0 {
-		logger.Info("List of files to remove: ")
+		log.Info("List of files to remove:")
 		for _, file := range files {
-			logger.Info(file)
-			if err := os.Remove(file); err != nil {
+			if err := ctx.Err(); err != nil {
+				return removed, multierror.Append(errors, err)
+			}
+			file := filepath.Join(o.DestinationPath, filepath.FromSlash(file.Name))
+			log.Info(file)
+			_, span := tracing.Start(ctx, "retention.delete", tracing.AttrSnapshot.String(file))
+			err := os.Remove(file)
+			tracing.End(span, err)
+			if err != nil {
 				errors = multierror.Append(errors, err)
+				continue
 			}
+			removed++
+			removeEmptyDirs(log, filepath.Dir(file), o.DestinationPath)
 		}
 	}
 
-	return errors
+	return removed, errors
+}
+
+// List returns the snapshots of the output, found anywhere under DestinationPath
+func (o *LocalOutput) List(ctx context.Context) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	err := filepath.WalkDir(o.DestinationPath, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(o.DestinationPath, file)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !o.Match(name) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, Snapshot{Name: name, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return snapshots, err
 }
 
-func findFilesOlderThan(dir string, period time.Duration) (fileList []string, err error) {
-	entries, err := os.ReadDir(dir)
+// Open opens the snapshot name, relative to DestinationPath
+func (o *LocalOutput) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(o.DestinationPath, filepath.FromSlash(name)))
+}
+
+// removeEmptyDirs removes dir, and then its parents up to root (excluded), as long as they are empty
+func removeEmptyDirs(log *logger.Logger, dir, root string) {
+	for {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return
+		}
+		// fails on the first directory that is not empty
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		log.Debug("Removed empty directory: ", dir)
+		dir = filepath.Dir(dir)
+	}
+}
+
+// copyFile copies src to dst, no faster than limiters allow, aborting as soon as ctx is done,
+// and returns the number of bytes copied. A partially written dst is removed on failure.
+func copyFile(ctx context.Context, src, dst string, limiters ...*throttle.Limiter) (int64, error) {
+	in, err := os.Open(src)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	defer in.Close()
 
-	for _, entry := range entries {
-		file, _ := entry.Info()
-		if file.Mode().IsRegular() {
-			if time.Since(file.ModTime()) > period {
-				fileList = append(fileList, path.Join(dir, file.Name()))
-			}
-		}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(out, throttle.NewReader(ctx, in, limiters...))
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		return 0, err
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return 0, err
 	}
-	return fileList, nil
+	return n, nil
 }
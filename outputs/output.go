@@ -0,0 +1,41 @@
+package outputs
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Output exports the snapshots to a destination, and prunes the old ones from it.
+// Save returns the number of bytes written to the destination,
+// and ApplyRetentionPolicy the number of snapshots it removed.
+// Open reads back a snapshot, named as in List, which the caller must close.
+type Output interface {
+	Save(ctx context.Context, snap string) (int64, error)
+	List(ctx context.Context) ([]Snapshot, error)
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	ApplyRetentionPolicy(ctx context.Context) (int, error)
+}
+
+// Snapshot is a snapshot saved by an output
+type Snapshot struct {
+	// Name is the slash-separated path of the snapshot, relative to the root of the output
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Matcher reports whether name, relative to the root of an output, is a snapshot saved by that output.
+// Listings only include, and retention policies only remove, the files that match.
+type Matcher func(name string) bool
+
+// olderThan returns the snapshots last modified more than period ago
+func olderThan(snapshots []Snapshot, period time.Duration) []Snapshot {
+	var old []Snapshot
+	for _, s := range snapshots {
+		if time.Since(s.ModTime) > period {
+			old = append(old, s)
+		}
+	}
+	return old
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/ruizink/consul-snapshotter/secrets"
+)
+
+// secretSetting is a setting tagged `secret:"true"`, along with its "<name>-file" sibling setting, if any
+type secretSetting struct {
+	key string
+	// label names the setting in errors, with the list entries named after their name, if they have one (e.g. "outputs[geo].storage-access-key")
+	label string
+	value reflect.Value
+	file  string
+}
+
+// resolveSecrets fills in the secret settings that are read from a file (their "<name>-file" setting),
+// or that reference a secret provider ("vault:<mount>/<path>#<field>" or "exec:<command>").
+// The tokens of the secret providers themselves can only be read from files.
+// It returns a *multierror.Error listing all the secrets that could not be read.
+func resolveSecrets(c *config) error {
+	var errs error
+
+	secretsValue := reflect.ValueOf(&c.Secrets).Elem()
+	for _, s := range secretSettings("secrets", "secrets", secretsValue) {
+		if err := readSecretFile(c, s); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+
+	resolver := secrets.NewResolver()
+	resolver.Register("vault", secrets.NewVaultProvider(&secrets.VaultConfig{
+		Address:   c.Secrets.Vault.Address,
+		Token:     c.Secrets.Vault.Token,
+		Namespace: c.Secrets.Vault.Namespace,
+		Timeout:   c.Secrets.Vault.Timeout,
+	}))
+	resolver.Register("exec", &secrets.ExecProvider{Timeout: c.Secrets.Exec.Timeout})
+
+	resolved := map[string]string{}
+	for _, s := range secretSettings("", "", reflect.ValueOf(c).Elem()) {
+		if strings.HasPrefix(s.key, "secrets.") {
+			continue
+		}
+		if err := readSecretFile(c, s); err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		ref := s.value.String()
+		scheme, _, ok := resolver.IsReference(ref)
+		if !ok {
+			continue
+		}
+		// outputs inherit the secrets of the block of their type, so the same reference is usually found more than once
+		secret, cached := resolved[ref]
+		if !cached {
+			var err error
+			if secret, err = resolver.Resolve(context.Background(), ref); err != nil {
+				errs = multierror.Append(errs, fmt.Errorf("%s: %v", s.label, err))
+				continue
+			}
+			resolved[ref] = secret
+		}
+		s.value.SetString(secret)
+		c.sources[s.key] += " via " + scheme
+	}
+
+	return errs
+}
+
+// readSecretFile sets the value of s to the content of its file, if one is set
+func readSecretFile(c *config, s secretSetting) error {
+	if s.file == "" {
+		return nil
+	}
+	if s.value.String() != "" {
+		return fmt.Errorf("%s: mutually exclusive with %s-file", s.label, s.label)
+	}
+	secret, err := secrets.ReadFile(s.file)
+	if err != nil {
+		return fmt.Errorf("%s-file: %v", s.label, err)
+	}
+	s.value.SetString(secret)
+	c.sources[s.key] = sourceFile + " " + s.file
+	return nil
+}
+
+// secretSettings finds the secret settings of the struct v, keyed as in configFields, and labelled after label
+func secretSettings(key, label string, v reflect.Value) []secretSetting {
+	var settings []secretSetting
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			settings = append(settings, secretSettings(key, label, v.Elem())...)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			itemLabel := joinKey(label, fmt.Sprint(i))
+			if item := v.Index(i); item.Kind() == reflect.Struct {
+				if name := fieldByJSONName(item, "name"); name.IsValid() && name.String() != "" {
+					itemLabel = fmt.Sprintf("%s[%s]", label, name.String())
+				}
+			}
+			settings = append(settings, secretSettings(joinKey(key, fmt.Sprint(i)), itemLabel, v.Index(i))...)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, inline := jsonName(t.Field(i))
+			if name == "" {
+				continue
+			}
+			field := v.Field(i)
+			if t.Field(i).Tag.Get("secret") != "true" || field.Kind() != reflect.String {
+				fieldKey, fieldLabel := joinKey(key, name), joinKey(label, name)
+				if inline {
+					fieldKey, fieldLabel = key, label
+				}
+				settings = append(settings, secretSettings(fieldKey, fieldLabel, field)...)
+				continue
+			}
+			s := secretSetting{key: joinKey(key, name), label: joinKey(label, name), value: field}
+			if file := fieldByJSONName(v, name+"-file"); file.IsValid() {
+				s.file = file.String()
+			}
+			settings = append(settings, s)
+		}
+	}
+
+	return settings
+}
+
+// fieldByJSONName returns the field of the struct v with the given json name, or an invalid value
+func fieldByJSONName(v reflect.Value, name string) reflect.Value {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ","); tag == name {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecrets(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" || r.URL.Path != "/v1/secret/data/backups" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(`{"data":{"data":{"consul-token":"from-vault","sas":"sv=1&sig=x"}}}`))
+	}))
+	defer vault.Close()
+
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	vaultTokenFile := writeFile("vault-token", "vault-token\n")
+	keyFile := writeFile("geo-key", "from-file\n")
+
+	tests := []struct {
+		name string
+		// setup sets the secrets of c, on top of a Vault at the fake address with the token file
+		setup   func(c *config)
+		check   func(t *testing.T, c *config)
+		wantErr []string
+	}{
+		{
+			name:  "plain values are kept",
+			setup: func(c *config) { c.ConsulConfig.Token = "plain" },
+			check: func(t *testing.T, c *config) { assertEqual(t, c.ConsulConfig.Token, "plain") },
+		},
+		{
+			name:  "file",
+			setup: func(c *config) { c.Outputs = []outputConfig{azureOutput("geo", "", keyFile)} },
+			check: func(t *testing.T, c *config) {
+				assertEqual(t, c.Outputs[0].AzureBlob.StorageAccessKey, "from-file")
+				assertEqual(t, c.sources["outputs.0.storage-access-key"], "file "+keyFile)
+			},
+		},
+		{
+			name: "vault",
+			setup: func(c *config) {
+				c.ConsulConfig.Token = "vault:secret/backups#consul-token"
+				c.AzureOutputConfig.StorageSASToken = "vault:secret/backups#sas"
+			},
+			check: func(t *testing.T, c *config) {
+				assertEqual(t, c.ConsulConfig.Token, "from-vault")
+				assertEqual(t, c.AzureOutputConfig.StorageSASToken, "sv=1&sig=x")
+				assertEqual(t, c.sources["consul.token"], "file via vault")
+			},
+		},
+		{
+			name:  "exec",
+			setup: func(c *config) { c.ConsulConfig.Token = "exec:echo from-exec" },
+			check: func(t *testing.T, c *config) { assertEqual(t, c.ConsulConfig.Token, "from-exec") },
+		},
+		{
+			name: "errors name the settings, and list entries after their name",
+			setup: func(c *config) {
+				c.ConsulConfig.Token = "vault:secret/other#consul-token"
+				c.Outputs = []outputConfig{
+					azureOutput("primary", "vault:secret/backups#missing", ""),
+					azureOutput("geo", "inline", keyFile),
+					azureOutput("dr", "", filepath.Join(dir, "missing")),
+				}
+			},
+			wantErr: []string{
+				"consul.token: vault secret provider: error reading secret secret/other: 403 Forbidden permission denied",
+				`outputs[primary].storage-access-key: vault secret provider: secret secret/backups has no field "missing"`,
+				"outputs[geo].storage-access-key: mutually exclusive with outputs[geo].storage-access-key-file",
+				"outputs[dr].storage-access-key-file: open " + filepath.Join(dir, "missing"),
+			},
+		},
+		{
+			name: "provider token file",
+			setup: func(c *config) {
+				c.Secrets.Vault.TokenFile = filepath.Join(dir, "missing")
+			},
+			wantErr: []string{"secrets.vault.token-file: open "},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &config{sources: map[string]string{"consul.token": "file"}}
+			c.Secrets.Vault.Address = vault.URL
+			c.Secrets.Vault.TokenFile = vaultTokenFile
+			tt.setup(c)
+
+			err := resolveSecrets(c)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("resolveSecrets() error = %v", err)
+				}
+				tt.check(t, c)
+				return
+			}
+			if err == nil {
+				t.Fatal("resolveSecrets() succeeded, want an error")
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("resolveSecrets() error = %v, want one containing %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+// azureOutput returns an azure_blob output named name, with the given access key and key file
+func azureOutput(name, key, keyFile string) outputConfig {
+	return outputConfig{Name: name, Type: outputTypeAzureBlob, AzureBlob: &azureOutputConfig{
+		StorageAccessKey:     key,
+		StorageAccessKeyFile: keyFile,
+	}}
+}
+
+func assertEqual(t *testing.T, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/metrics"
+)
+
+// outputResult is the outcome of exporting a snapshot to one output
+type outputResult struct {
+	Name     string
+	Type     string
+	Required bool
+	// Skipped is set when the output holds a snapshot of the same cluster state already
+	Skipped  bool
+	Bytes    int64
+	Duration time.Duration
+	// Deleted is the number of snapshots removed by the retention policy
+	Deleted int
+	// SaveErr is set when the snapshot could not be saved, in which case the retention policy is not applied
+	SaveErr      error
+	RetentionErr error
+}
+
+// err returns the first error of r, if any
+func (r outputResult) err() error {
+	if r.SaveErr != nil {
+		return r.SaveErr
+	}
+	return r.RetentionErr
+}
+
+// status describes the outcome of r in a word
+func (r outputResult) status() string {
+	switch {
+	case r.SaveErr != nil:
+		return "failed"
+	case r.RetentionErr != nil:
+		return "retention-failed"
+	case r.Skipped:
+		return "skipped"
+	}
+	return "ok"
+}
+
+// logRunSummary logs the result of every output of a backup run that took elapsed
+func logRunSummary(ctx context.Context, results []outputResult, elapsed time.Duration) {
+	log := logger.FromContext(ctx)
+	saved, skipped := 0, 0
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			skipped++
+		case r.SaveErr == nil:
+			saved++
+		}
+	}
+	summary := fmt.Sprintf("===> Run summary: snapshot saved to %d/%d outputs in %v", saved, len(results), elapsed.Round(time.Millisecond))
+	if skipped > 0 {
+		summary += fmt.Sprintf(" (%d skipped, cluster unchanged)", skipped)
+	}
+	log.Info(summary)
+	for _, r := range results {
+		l := log.With("output", r.Name, "type", r.Type, "required", r.Required, "status", r.status(),
+			"bytes", r.Bytes, "deleted", r.Deleted, "duration", r.Duration.Round(time.Millisecond).String())
+		if err := r.err(); err != nil {
+			l.With("error", err.Error()).Error("Output failed")
+			continue
+		}
+		l.Info("Output done")
+	}
+}
+
+// recordOutputMetrics records the outcome of every output in the metrics
+func recordOutputMetrics(cluster string, results []outputResult) {
+	now := float64(time.Now().Unix())
+	for _, r := range results {
+		metrics.UploadBytes.WithLabelValues(cluster, r.Name).Add(float64(r.Bytes))
+		metrics.RetentionDeletions.WithLabelValues(cluster, r.Name).Add(float64(r.Deleted))
+		if r.SaveErr != nil {
+			metrics.UploadErrors.WithLabelValues(cluster, r.Name).Inc()
+			continue
+		}
+		metrics.LastSuccess.WithLabelValues(cluster, r.Name).Set(now)
+		if r.RetentionErr != nil {
+			metrics.RetentionErrors.WithLabelValues(cluster, r.Name).Inc()
+		}
+	}
+}
+
+// outputsError returns the errors of the outputs, with the exit code of the most severe one:
+// a required output that could not save the snapshot, then a required output that could not apply its retention policy,
+// then a best-effort output that failed either way.
+func outputsError(results []outputResult) error {
+	var errs error
+	code := exitOK
+	for _, r := range results {
+		err := r.err()
+		if err == nil {
+			continue
+		}
+		errs = multierror.Append(errs, fmt.Errorf("output %s: %v", r.Name, err))
+
+		c := exitBestEffortOutputFailed
+		switch {
+		case r.Required && r.SaveErr != nil:
+			c = exitRequiredOutputFailed
+		case r.Required:
+			c = exitRetentionFailed
+		}
+		if code == exitOK || severity[c] > severity[code] {
+			code = c
+		}
+	}
+	if errs == nil {
+		return nil
+	}
+	return &runError{code, errs}
+}
+
+// severity ranks the exit codes of the output failures
+var severity = map[int]int{
+	exitBestEffortOutputFailed: 1,
+	exitRetentionFailed:        2,
+	exitRequiredOutputFailed:   3,
+}
@@ -0,0 +1,133 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ruizink/consul-snapshotter/logger"
+)
+
+// Policy defines how many times, and how often, an operation is attempted
+type Policy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one
+	MaxAttempts int
+	// InitialBackoff is the wait before the second attempt, doubled before each of the next ones
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts
+	MaxBackoff time.Duration
+	// Jitter randomizes each wait by up to this fraction of it (e.g. 0.2 for ±20%)
+	Jitter float64
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable, runs out of attempts, or ctx is done.
+// Each failed attempt is logged with the logger of ctx.
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	maxAttempts := max(p.MaxAttempts, 1)
+
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || !IsRetryable(err) {
+			return err
+		}
+		if attempt == maxAttempts {
+			if attempt == 1 {
+				return err
+			}
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		wait := p.backoff(attempt)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("retry.attempt", attempt),
+			attribute.String("retry.error", err.Error()),
+			attribute.String("retry.wait", wait.Round(time.Millisecond).String()),
+		))
+		logger.FromContext(ctx).Warn(fmt.Sprintf("Attempt %d/%d failed: %v. Retrying in %v", attempt, maxAttempts, err, wait.Round(time.Millisecond)))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns the wait after the given failed attempt
+func (p Policy) backoff(attempt int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < attempt && (p.MaxBackoff <= 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		wait += time.Duration(float64(wait) * p.Jitter * (2*rand.Float64() - 1))
+	}
+	return wait
+}
+
+// retryableStatusCodes are the HTTP status codes of the responses worth retrying
+var retryableStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// retryableErrnos are the system errors that are usually transient, on the network or on network filesystems
+var retryableErrnos = []syscall.Errno{
+	syscall.ECONNRESET,
+	syscall.ECONNREFUSED,
+	syscall.ECONNABORTED,
+	syscall.EPIPE,
+	syscall.ETIMEDOUT,
+	syscall.EHOSTUNREACH,
+	syscall.ENETUNREACH,
+	syscall.EAGAIN,
+	syscall.EIO,
+	syscall.ESTALE,
+}
+
+// IsRetryable reports whether err is likely transient, so that the operation that failed with it is worth retrying.
+// A context.DeadlineExceeded is retryable, as it can only come from the timeout of a single attempt.
+func IsRetryable(err error) bool {
+	var respErr *azcore.ResponseError
+	if errors.As(err, &respErr) {
+		return retryableStatusCodes[respErr.StatusCode]
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	for _, errno := range retryableErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+		// want are the waits after each failed attempt, from the first one
+		want []time.Duration
+	}{
+		{
+			name:   "doubled up to the maximum",
+			policy: Policy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second},
+			want:   []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second},
+		},
+		{
+			name:   "no maximum",
+			policy: Policy{InitialBackoff: time.Second},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second},
+		},
+		{
+			name:   "initial above the maximum",
+			policy: Policy{InitialBackoff: 5 * time.Second, MaxBackoff: 2 * time.Second},
+			want:   []time.Duration{2 * time.Second, 2 * time.Second},
+		},
+		{
+			name:   "no backoff",
+			policy: Policy{},
+			want:   []time.Duration{0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				if got := tt.policy.backoff(i + 1); got != want {
+					t.Errorf("backoff(%d) = %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	p := Policy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Jitter: 0.2}
+	for attempt, base := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 8: time.Second} {
+		low, high := time.Duration(float64(base)*0.8), time.Duration(float64(base)*1.2)
+		seen := map[time.Duration]bool{}
+		for range 1000 {
+			got := p.backoff(attempt)
+			if got < low || got > high {
+				t.Fatalf("backoff(%d) = %v, want it within [%v, %v]", attempt, got, low, high)
+			}
+			seen[got] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("backoff(%d) is always %v, want it randomized", attempt, p.backoff(attempt))
+		}
+	}
+}
+
+func TestDo(t *testing.T) {
+	retryable := fmt.Errorf("upload: %w", syscall.ECONNRESET)
+	permanent := errors.New("container not found")
+
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		errs         []error
+		wantAttempts int
+		wantErr      string
+	}{
+		{name: "success", maxAttempts: 3, wantAttempts: 1},
+		{name: "recovers", maxAttempts: 3, errs: []error{retryable, retryable}, wantAttempts: 3},
+		{name: "gives up", maxAttempts: 3, errs: []error{retryable, retryable, retryable, retryable}, wantAttempts: 3, wantErr: "giving up after 3 attempts: upload: connection reset by peer"},
+		{name: "not retryable", maxAttempts: 3, errs: []error{retryable, permanent}, wantAttempts: 2, wantErr: "container not found"},
+		{name: "a single attempt", maxAttempts: 1, errs: []error{retryable}, wantAttempts: 1, wantErr: "upload: connection reset by peer"},
+		{name: "at least one attempt", maxAttempts: 0, errs: []error{retryable}, wantAttempts: 1, wantErr: "upload: connection reset by peer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Policy{MaxAttempts: tt.maxAttempts, InitialBackoff: time.Millisecond}
+			attempts := 0
+			err := p.Do(context.Background(), func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Do() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Do() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := Policy{MaxAttempts: 5, InitialBackoff: time.Hour}
+	attempts := 0
+	start := time.Now()
+	err := p.Do(ctx, func(ctx context.Context) error {
+		attempts++
+		time.AfterFunc(20*time.Millisecond, cancel)
+		return syscall.ECONNREFUSED
+	})
+	if !errors.Is(err, syscall.ECONNREFUSED) || attempts != 1 {
+		t.Errorf("Do() = %v after %d attempts, want the first error", err, attempts)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Do() gave up after %v, want it to give up with its context", elapsed)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "timeout of an attempt", err: fmt.Errorf("save: %w", context.DeadlineExceeded), want: true},
+		{name: "truncated response", err: io.ErrUnexpectedEOF, want: true},
+		{name: "connection refused", err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "stale NFS handle", err: &os.PathError{Op: "write", Path: "/mnt/backups/x.snap", Err: syscall.ESTALE}, want: true},
+		{name: "throttled", err: &azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, want: true},
+		{name: "server error", err: fmt.Errorf("upload: %w", &azcore.ResponseError{StatusCode: http.StatusServiceUnavailable}), want: true},
+		{name: "forbidden", err: &azcore.ResponseError{StatusCode: http.StatusForbidden}},
+		{name: "canceled", err: context.Canceled},
+		{name: "missing directory", err: &os.PathError{Op: "open", Path: "/mnt/backups", Err: syscall.ENOENT}},
+		{name: "disk full", err: &os.PathError{Op: "write", Path: "/mnt/backups/x.snap", Err: syscall.ENOSPC}},
+		{name: "plain error", err: errors.New("invalid snapshot name")},
+	}
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.want {
+			t.Errorf("IsRetryable(%s: %v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRuns is the number of finished runs kept for the control API
+const maxRuns = 50
+
+// what started a backup run
+const (
+	triggerSingle   = "single-execution"
+	triggerSchedule = "schedule"
+	triggerAPI      = "api"
+)
+
+// states of a backup run
+const (
+	runRunning   = "running"
+	runSucceeded = "succeeded"
+	runFailed    = "failed"
+	runCancelled = "cancelled"
+)
+
+// backupRun is a backup run, tracked from start to finish so that it can be inspected and cancelled
+type backupRun struct {
+	ID      string
+	Trigger string
+	// Outputs are the names of the outputs to export the snapshot to, or all of them if empty
+	Outputs []string
+	// Force uploads the snapshot even to the outputs that hold the same cluster state already
+	Force     bool
+	CreatedAt time.Time
+
+	cancel context.CancelFunc
+
+	// guards all the fields below
+	mu         sync.Mutex
+	state      string
+	step       string
+	finishedAt time.Time
+	cancelled  bool
+	result     string
+	err        error
+	outputs    map[string]outputRecord
+}
+
+// backupRunView is the JSON representation of a backupRun
+type backupRunView struct {
+	ID         string                  `json:"id"`
+	Trigger    string                  `json:"trigger"`
+	Outputs    []string                `json:"requested-outputs,omitempty"`
+	Force      bool                    `json:"force"`
+	State      string                  `json:"state"`
+	Step       string                  `json:"step,omitempty"`
+	CreatedAt  time.Time               `json:"created-at"`
+	FinishedAt *time.Time              `json:"finished-at,omitempty"`
+	Result     string                  `json:"result,omitempty"`
+	Error      string                  `json:"error,omitempty"`
+	Results    map[string]outputRecord `json:"outputs"`
+}
+
+func newBackupRun(trigger string, outputs []string, force bool) *backupRun {
+	return &backupRun{
+		ID:        newRunID(),
+		Trigger:   trigger,
+		Outputs:   outputs,
+		Force:     force,
+		CreatedAt: time.Now().UTC(),
+		state:     runRunning,
+		outputs:   map[string]outputRecord{},
+	}
+}
+
+// setStep records the step the run is at (e.g. "snapshot")
+func (r *backupRun) setStep(step string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.step = step
+}
+
+// outputDone records the result of an output, as soon as it is done
+func (r *backupRun) outputDone(res outputResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputs[res.Name] = newOutputRecord(res, time.Now().UTC())
+}
+
+// finish records the end of the run, which ended with err
+func (r *backupRun) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.step = ""
+	r.finishedAt = time.Now().UTC()
+	r.result = runResult(err)
+	r.err = err
+	switch {
+	case r.cancelled && err != nil:
+		// the errors of the steps do not always wrap context.Canceled
+		r.state = runCancelled
+	case err != nil:
+		r.state = runFailed
+	default:
+		r.state = runSucceeded
+	}
+}
+
+// requestCancel cancels the run, returning false if it had finished already
+func (r *backupRun) requestCancel() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != runRunning {
+		return false
+	}
+	r.cancelled = true
+	if r.cancel != nil {
+		r.cancel()
+	}
+	return true
+}
+
+// wasCancelled reports whether the run was asked to be cancelled
+func (r *backupRun) wasCancelled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cancelled
+}
+
+func (r *backupRun) finished() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state != runRunning
+}
+
+func (r *backupRun) view() backupRunView {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	v := backupRunView{
+		ID:        r.ID,
+		Trigger:   r.Trigger,
+		Outputs:   r.Outputs,
+		Force:     r.Force,
+		State:     r.state,
+		Step:      r.step,
+		CreatedAt: r.CreatedAt,
+		Result:    r.result,
+		Results:   map[string]outputRecord{},
+	}
+	if !r.finishedAt.IsZero() {
+		t := r.finishedAt
+		v.FinishedAt = &t
+	}
+	if r.err != nil {
+		v.Error = r.err.Error()
+	}
+	for name, o := range r.outputs {
+		v.Results[name] = o
+	}
+	return v
+}
+
+// runRegistry keeps the running backups, and the last maxRuns finished ones
+type runRegistry struct {
+	mu   sync.Mutex
+	runs map[string]*backupRun
+}
+
+func (rr *runRegistry) add(r *backupRun) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if rr.runs == nil {
+		rr.runs = map[string]*backupRun{}
+	}
+	rr.runs[r.ID] = r
+
+	// forget the oldest finished runs
+	var finished []*backupRun
+	for _, run := range rr.runs {
+		if run.finished() {
+			finished = append(finished, run)
+		}
+	}
+	if len(finished) <= maxRuns {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].CreatedAt.Before(finished[j].CreatedAt) })
+	for _, run := range finished[:len(finished)-maxRuns] {
+		delete(rr.runs, run.ID)
+	}
+}
+
+func (rr *runRegistry) get(id string) *backupRun {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return rr.runs[id]
+}
+
+// list returns the runs, the newest first
+func (rr *runRegistry) list() []*backupRun {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	runs := make([]*backupRun, 0, len(rr.runs))
+	for _, r := range rr.runs {
+		runs = append(runs, r)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].CreatedAt.After(runs[j].CreatedAt) })
+	return runs
+}
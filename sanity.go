@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/ruizink/consul-snapshotter/consul"
+	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/metrics"
+	"github.com/ruizink/consul-snapshotter/naming"
+	"github.com/ruizink/consul-snapshotter/tracing"
+)
+
+// inspects reports whether any check needs the contents of the snapshot
+func (sc sanityChecksConfig) inspects() bool {
+	return sc.MinKVEntries > 0 || sc.MinNodes > 0 || sc.MinServices > 0 || len(sc.RequiredKVPrefixes) > 0
+}
+
+// keepsState reports whether the backup state is recorded in Consul KV, at consul.state-key
+func (c *config) keepsState() bool {
+	return c.SkipUnchanged.Enabled || c.SanityChecks.MaxShrink > 0
+}
+
+// checkSanity asserts that snap holds what a snapshot of the cluster should, as set by c.SanityChecks, comparing
+// its size with the last snapshot that passed the checks, in state, or else with the newest one saved to outs,
+// named after tmpl. A nil state could not be read, and fails the max-shrink check. It returns the failed checks.
+func checkSanity(ctx context.Context, snap *consul.Snapshot, state *backupState, tmpl *naming.Template, outs []outputConfig, cluster string, c *config) (err error) {
+	sc := c.SanityChecks
+	if !sc.inspects() && sc.MaxShrink == 0 {
+		return nil
+	}
+
+	ctx, span := tracing.Start(ctx, "sanity-checks")
+	defer func() { tracing.End(span, err) }()
+	log := logger.FromContext(ctx)
+
+	var errs error
+	fail := func(check string, format string, a ...interface{}) {
+		metrics.SanityCheckFailures.WithLabelValues(cluster, check).Inc()
+		errs = multierror.Append(errs, fmt.Errorf(format, a...))
+	}
+
+	if sc.inspects() {
+		contents, err := consul.Inspect(snap.File, sc.RequiredKVPrefixes, c.ConsulConfig.LockKey, c.ConsulConfig.StateKey)
+		if err != nil {
+			fail("inspect", "could not inspect the snapshot: %v", err)
+		} else {
+			span.SetAttributes(
+				attribute.Int("snapshot.kv_entries", contents.KVEntries),
+				attribute.Int("snapshot.nodes", contents.Nodes),
+				attribute.Int("snapshot.services", contents.Services),
+			)
+			log.Debug(fmt.Sprintf("Snapshot contents: %d KV entries, %d nodes, %d services", contents.KVEntries, contents.Nodes, contents.Services))
+			for _, p := range sc.contentsProblems(contents, "the snapshot") {
+				fail(p.check, "%v", p.err)
+			}
+		}
+	}
+
+	if sc.MaxShrink > 0 {
+		if state == nil {
+			// the state of a wiped cluster may be gone along with it, which must not let its snapshot pass
+			fail("max-shrink", "could not read the last snapshot that passed the checks from %s, to compare the size with", c.ConsulConfig.StateKey)
+		} else {
+			last, what, err := shrinkBaseline(ctx, state, tmpl, outs, cluster, c)
+			switch {
+			case err != nil:
+				fail("max-shrink", "%v", err)
+			case last == nil:
+				log.Info("No snapshot passed the sanity checks or was saved yet, skipping the max-shrink check")
+			case snap.Size < last.Size:
+				if shrink := 1 - float64(snap.Size)/float64(last.Size); shrink > sc.MaxShrink {
+					fail("max-shrink", "the snapshot is %.0f%% smaller than %s (%d bytes, against %d), expected at most %.0f%%",
+						shrink*100, what, snap.Size, last.Size, sc.MaxShrink*100)
+				}
+			}
+		}
+	}
+
+	if errs != nil {
+		return &runError{exitSanityCheckFailed, errs}
+	}
+	log.Info("The snapshot passed the sanity checks")
+	return nil
+}
+
+// shrinkBaseline returns the snapshot to compare the size of a new one with, and what it is: the last one that passed
+// the checks, in state, or else the newest one of cluster saved to outs, as the state of a wiped cluster is gone along with it.
+// The latter is recorded in state, so that the snapshots saved after failing the check do not become the baseline.
+// It returns nil if there is none yet.
+func shrinkBaseline(ctx context.Context, state *backupState, tmpl *naming.Template, outs []outputConfig, cluster string, c *config) (*snapshotState, string, error) {
+	if last := state.LastSnapshot; last != nil && last.Size > 0 {
+		return last, fmt.Sprintf("the last one that passed the checks (index %d)", last.LastIndex), nil
+	}
+
+	var (
+		newest *snapshotInfo
+		from   string
+		errs   error
+	)
+	for _, oc := range outs {
+		snapshots, err := listSnapshots(ctx, c, tmpl, oc, cluster)
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", oc.Name, err))
+			continue
+		}
+		for i := range snapshots {
+			if newest == nil || snapshots[i].takenAt().After(newest.takenAt()) {
+				newest, from = &snapshots[i], oc.Name
+			}
+		}
+	}
+	if newest == nil {
+		if errs != nil {
+			return nil, "", fmt.Errorf("could not list the saved snapshots, to compare the size with: %v", errs)
+		}
+		return nil, "", nil
+	}
+	if errs != nil {
+		logger.FromContext(ctx).Warn("Could not list the snapshots of every output, comparing the size with the newest one found: ", errs)
+	}
+
+	state.LastSnapshot = &snapshotState{LastIndex: newest.LastIndex, Size: newest.Size, TakenAt: newest.takenAt()}
+	return state.LastSnapshot, fmt.Sprintf("the newest one saved to %s (%s)", from, newest.Name), nil
+}
+
+// sanityProblem is a failed sanity check
+type sanityProblem struct {
+	check string
+	err   error
+}
+
+// contentsProblems lists the checks that contents, of what (e.g. "the snapshot"), fails
+func (sc sanityChecksConfig) contentsProblems(contents *consul.Contents, what string) []sanityProblem {
+	var problems []sanityProblem
+	fail := func(check string, format string, a ...interface{}) {
+		problems = append(problems, sanityProblem{check, fmt.Errorf(what+" "+format, a...)})
+	}
+	if contents.KVEntries < sc.MinKVEntries {
+		fail("min-kv-entries", "holds %d KV entries, expected at least %d", contents.KVEntries, sc.MinKVEntries)
+	}
+	if contents.Nodes < sc.MinNodes {
+		fail("min-nodes", "holds %d nodes, expected at least %d", contents.Nodes, sc.MinNodes)
+	}
+	if contents.Services < sc.MinServices {
+		fail("min-services", "holds %d services, expected at least %d", contents.Services, sc.MinServices)
+	}
+	for _, prefix := range sc.RequiredKVPrefixes {
+		if contents.KVPrefixes[prefix] == 0 {
+			fail("required-kv-prefixes", "holds no KV entry under %q", prefix)
+		}
+	}
+	return problems
+}
+
+// sanityError returns the error of a run that exported a snapshot that failed the sanity checks with checksErr,
+// along with the errors of the outputs, if any
+func sanityError(checksErr, outputsErr error) error {
+	errs := multierror.Append(nil, checksErr)
+	if outputsErr != nil {
+		errs = multierror.Append(errs, outputsErr)
+	}
+	return &runError{exitSanityCheckFailed, errs}
+}
+
+// snapshotState is the last snapshot that passed the sanity checks
+type snapshotState struct {
+	LastIndex uint64    `json:"last-index"`
+	Size      int64     `json:"size"`
+	TakenAt   time.Time `json:"taken-at"`
+}
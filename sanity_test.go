@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ruizink/consul-snapshotter/consul"
+	"github.com/ruizink/consul-snapshotter/naming"
+)
+
+func TestCheckSanityMaxShrink(t *testing.T) {
+	tmpl, err := naming.New(naming.DefaultTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		// saved are the sizes of the snapshots saved to the output, taken an hour apart from the oldest
+		saved []int
+		state *backupState
+		size  int64
+		// wantErr is empty if the check passes
+		wantErr string
+		// wantBaseline is the size recorded in the state as the last snapshot, if any
+		wantBaseline int64
+	}{
+		{
+			name:         "wiped cluster and state",
+			saved:        []int{100, 1000},
+			state:        &backupState{},
+			size:         200,
+			wantErr:      "80% smaller than the newest one saved to local (consul-snapshot-local-",
+			wantBaseline: 1000,
+		},
+		{
+			name:         "wiped cluster, saved after failing the check",
+			saved:        []int{1000, 200},
+			state:        &backupState{LastSnapshot: &snapshotState{LastIndex: 7, Size: 1000}},
+			size:         200,
+			wantErr:      "80% smaller than the last one that passed the checks (index 7)",
+			wantBaseline: 1000,
+		},
+		{
+			name:         "no state yet, within the limit",
+			saved:        []int{1000},
+			state:        &backupState{},
+			size:         600,
+			wantBaseline: 1000,
+		},
+		{
+			name:         "the state wins over the outputs",
+			saved:        []int{1000},
+			state:        &backupState{LastSnapshot: &snapshotState{Size: 300}},
+			size:         200,
+			wantBaseline: 300,
+		},
+		{
+			name:  "first run",
+			state: &backupState{},
+			size:  200,
+		},
+		{
+			name:    "unreadable state",
+			saved:   []int{100},
+			size:    200,
+			wantErr: "could not read the last snapshot that passed the checks",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := &config{FilenamePrefix: "consul-snapshot-", FileExtension: ".snap"}
+			c.SanityChecks.MaxShrink = 0.5
+			outs := []outputConfig{{Name: "local", Type: outputTypeLocal, Local: &localOutputConfig{DestinationPath: dir}}}
+			for i, size := range tt.saved {
+				name, err := tmpl.Render(naming.Data{Output: "local", Prefix: c.FilenamePrefix, Extension: c.FileExtension, Time: day.Add(time.Duration(i) * time.Hour)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, name), make([]byte, size), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// a file that is not a snapshot of the output
+			if err := os.WriteFile(filepath.Join(dir, "notes.txt"), make([]byte, 5000), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := checkSanity(context.Background(), &consul.Snapshot{LastIndex: 9, Size: tt.size}, tt.state, tmpl, outs, "dc1", c)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("checkSanity() error = %v", err)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("checkSanity() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				if code := exitCode(err); code != exitSanityCheckFailed {
+					t.Errorf("exit code = %d, want %d", code, exitSanityCheckFailed)
+				}
+			}
+
+			if tt.state == nil {
+				return
+			}
+			var got int64
+			if tt.state.LastSnapshot != nil {
+				got = tt.state.LastSnapshot.Size
+			}
+			if got != tt.wantBaseline {
+				t.Errorf("last snapshot size in the state = %d, want %d", got, tt.wantBaseline)
+			}
+		})
+	}
+}
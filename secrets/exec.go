@@ -0,0 +1,44 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ExecProvider reads secrets from the output of a command.
+// References are the command line to run, e.g. "/usr/local/bin/get-secret consul-token".
+// The command is run directly, not through a shell.
+type ExecProvider struct {
+	Timeout time.Duration
+}
+
+func (p *ExecProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	args := strings.Fields(ref)
+	if len(args) == 0 {
+		return "", fmt.Errorf("no command given")
+	}
+
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("error running %s: %v: %s", args[0], err, msg)
+		}
+		return "", fmt.Errorf("error running %s: %v", args[0], err)
+	}
+
+	return strings.TrimRight(stdout.String(), "\r\n"), nil
+}
@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Provider reads secrets from an external secret store
+type Provider interface {
+	// Resolve returns the value of the secret that ref points to
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// Resolver resolves references to secrets ("<scheme>:<ref>") with the provider registered for their scheme
+type Resolver struct {
+	providers map[string]Provider
+}
+
+func NewResolver() *Resolver {
+	return &Resolver{providers: map[string]Provider{}}
+}
+
+// Register makes p resolve the references with the given scheme
+func (r *Resolver) Register(scheme string, p Provider) {
+	r.providers[scheme] = p
+}
+
+// IsReference reports whether value is a reference to a registered provider, returning its scheme and ref
+func (r *Resolver) IsReference(value string) (scheme, ref string, ok bool) {
+	scheme, ref, found := strings.Cut(value, ":")
+	if !found {
+		return "", "", false
+	}
+	if _, registered := r.providers[scheme]; !registered {
+		return "", "", false
+	}
+	return scheme, ref, true
+}
+
+// Resolve returns the secret that value refers to, or value itself if it is not a reference
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	scheme, ref, ok := r.IsReference(value)
+	if !ok {
+		return value, nil
+	}
+	secret, err := r.providers[scheme].Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("%s secret provider: %v", scheme, err)
+	}
+	return secret, nil
+}
+
+// ReadFile reads a secret from a file, without the trailing newline most editors add
+func ReadFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
@@ -0,0 +1,172 @@
+package secrets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testVaultToken = "s.test-token"
+
+// newFakeVault serves the KV v2 API of a Vault holding the secret/consul-snapshotter secret,
+// for the test token, in the "ops" namespace
+func newFakeVault(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("X-Vault-Token") != testVaultToken {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/consul-snapshotter":
+			w.Write([]byte(`{"data":{"data":{"consul-token":"c0ffee","port":8500},"metadata":{"version":3}}}`))
+		case "/v1/secret/data/ops-only":
+			if r.Header.Get("X-Vault-Namespace") != "ops" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"errors":[]}`))
+				return
+			}
+			w.Write([]byte(`{"data":{"data":{"key":"namespaced"}}}`))
+		case "/v1/secret/data/garbled":
+			w.Write([]byte(`{"data":`))
+		case "/v1/secret/data/slow":
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`{"data":{"data":{"key":"late"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestResolverResolve(t *testing.T) {
+	vault := newFakeVault(t)
+
+	tests := []struct {
+		name    string
+		vault   VaultConfig
+		value   string
+		want    string
+		wantErr string
+	}{
+		{name: "plain value", value: "not-a-reference", want: "not-a-reference"},
+		{name: "unregistered scheme", value: "https://example.com", want: "https://example.com"},
+		{name: "vault string field", value: "vault:secret/consul-snapshotter#consul-token", want: "c0ffee"},
+		{name: "vault number field", value: "vault:secret/consul-snapshotter#port", want: "8500"},
+		{name: "vault leading slash", value: "vault:/secret/consul-snapshotter#consul-token", want: "c0ffee"},
+		{name: "vault namespace", vault: VaultConfig{Namespace: "ops"}, value: "vault:secret/ops-only#key", want: "namespaced"},
+		{name: "vault without namespace", value: "vault:secret/ops-only#key", wantErr: "vault secret provider: error reading secret secret/ops-only: 404 Not Found"},
+		{name: "vault missing field", value: "vault:secret/consul-snapshotter#nope", wantErr: `secret secret/consul-snapshotter has no field "nope"`},
+		{name: "vault missing secret", value: "vault:secret/missing#key", wantErr: "error reading secret secret/missing: 404 Not Found"},
+		{name: "vault bad token", vault: VaultConfig{Token: "wrong"}, value: "vault:secret/consul-snapshotter#consul-token", wantErr: "403 Forbidden permission denied"},
+		{name: "vault garbled response", value: "vault:secret/garbled#key", wantErr: "error decoding secret secret/garbled"},
+		{name: "vault timeout", vault: VaultConfig{Timeout: 50 * time.Millisecond}, value: "vault:secret/slow#key", wantErr: "context deadline exceeded"},
+		{name: "vault no field", value: "vault:secret/consul-snapshotter", wantErr: "invalid reference"},
+		{name: "vault no path", value: "vault:secret#key", wantErr: "invalid reference"},
+		{name: "vault no address", vault: VaultConfig{Address: "-"}, value: "vault:secret/consul-snapshotter#consul-token", wantErr: "no Vault address configured"},
+		{name: "exec output", value: "exec:echo s3cret", want: "s3cret"},
+		{name: "exec empty output", value: "exec:true", want: ""},
+		{name: "exec missing command", value: "exec:/nonexistent/get-secret", wantErr: "exec secret provider: error running /nonexistent/get-secret"},
+		{name: "exec no command", value: "exec: ", wantErr: "no command given"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc := tt.vault
+			switch vc.Address {
+			case "":
+				vc.Address = vault.URL
+			case "-":
+				vc.Address = ""
+			}
+			if vc.Token == "" {
+				vc.Token = testVaultToken
+			}
+			r := NewResolver()
+			r.Register("vault", NewVaultProvider(&vc))
+			r.Register("exec", &ExecProvider{Timeout: 5 * time.Second})
+
+			got, err := r.Resolve(context.Background(), tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Resolve(%q) error = %v, want one containing %q", tt.value, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve(%q) error = %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("Resolve(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecProviderErrors(t *testing.T) {
+	// commands are not run through a shell, so the failing one is a script
+	script := filepath.Join(t.TempDir(), "get-secret")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"access denied to $1\" >&2\nexit 3\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		ref     string
+		wantErr string
+	}{
+		{name: "stderr is reported", ref: script + " consul-token", wantErr: "exit status 3: access denied to consul-token"},
+		{name: "timeout", timeout: 50 * time.Millisecond, ref: "sleep 5", wantErr: "signal: killed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ExecProvider{Timeout: tt.timeout}
+			_, err := p.Resolve(context.Background(), tt.ref)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Resolve(%q) error = %v, want one containing %q", tt.ref, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "trailing newline", content: "s3cret\n", want: "s3cret"},
+		{name: "trailing CRLF", content: "s3cret\r\n", want: "s3cret"},
+		{name: "inner whitespace kept", content: " s3 cret \n", want: " s3 cret "},
+		{name: "empty", content: "", want: ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i)))
+			if err := os.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ReadFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ReadFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("ReadFile() of a missing file succeeded")
+	}
+}
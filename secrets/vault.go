@@ -0,0 +1,94 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type VaultConfig struct {
+	Address   string
+	Token     string
+	Namespace string
+	Timeout   time.Duration
+}
+
+// VaultProvider reads secrets from a Vault KV v2 secrets engine.
+// References have the form "<mount>/<path>#<field>", e.g. "secret/consul-snapshotter#consul-token".
+type VaultProvider struct {
+	config *VaultConfig
+	client *http.Client
+}
+
+func NewVaultProvider(config *VaultConfig) *VaultProvider {
+	return &VaultProvider{config: config, client: &http.Client{}}
+}
+
+func (p *VaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	if p.config.Address == "" {
+		return "", fmt.Errorf("no Vault address configured")
+	}
+
+	secretPath, field, ok := strings.Cut(ref, "#")
+	mount, secretPath, hasPath := strings.Cut(strings.Trim(secretPath, "/"), "/")
+	if !ok || field == "" || !hasPath {
+		return "", fmt.Errorf("invalid reference %q, expected <mount>/<path>#<field>", ref)
+	}
+
+	if p.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.config.Timeout)
+		defer cancel()
+	}
+
+	u, err := url.JoinPath(p.config.Address, "v1", mount, "data", secretPath)
+	if err != nil {
+		return "", fmt.Errorf("invalid Vault address: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.config.Token)
+	if p.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.config.Namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var secret struct {
+		Errors []string `json:"errors"`
+		Data   struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("error decoding secret %s/%s: %v", mount, secretPath, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error reading secret %s/%s: %s %s", mount, secretPath, resp.Status, strings.Join(secret.Errors, "; "))
+	}
+
+	value, ok := secret.Data.Data[field]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no field %q", mount, secretPath, field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ruizink/consul-snapshotter/consul"
+	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/metrics"
+)
+
+// serverShutdownTimeout bounds the time the HTTP server waits for the open requests on shutdown
+const serverShutdownTimeout = 5 * time.Second
+
+// probeTimeout bounds the Consul requests of the readiness and status endpoints
+const probeTimeout = 5 * time.Second
+
+// startHTTPServer serves the metrics, health and status endpoints, and the control API, of s on address until ctx is done.
+// The listener is opened before returning, so that a busy address fails the start.
+func startHTTPServer(ctx context.Context, address string, s *snapshotter) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", s.serveHealth)
+	mux.HandleFunc("GET /readyz", s.serveReady)
+	mux.HandleFunc("GET /status", s.serveStatus)
+	mux.HandleFunc("POST /v1/backups", s.authorized(s.createBackup))
+	mux.HandleFunc("GET /v1/backups", s.authorized(s.listBackups))
+	mux.HandleFunc("GET /v1/backups/{id}", s.authorized(s.getBackup))
+	mux.HandleFunc("DELETE /v1/backups/{id}", s.authorized(s.cancelBackup))
+	mux.HandleFunc("GET /v1/snapshots", s.authorized(s.listSnapshots))
+
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server stopped: ", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("Serving metrics, health, status and the control API on http://", ln.Addr().String())
+	return nil
+}
+
+// serveHealth reports whether the process is alive: for a scheduled execution, that the scheduler still starts the runs
+func (s *snapshotter) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkScheduler(); err != nil {
+		http.Error(w, "scheduler: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReady reports whether the snapshotter can take backups: Consul is reachable, the config file is valid,
+// and no more than http.max-failed-runs runs failed in a row. Every check is listed, with its outcome.
+func (s *snapshotter) serveReady(w http.ResponseWriter, r *http.Request) {
+	c := s.currentConfig()
+	checks := []struct {
+		name string
+		err  error
+	}{
+		{"consul", pingConsul(r.Context(), c)},
+		{"config", s.checkConfig()},
+		{"runs", s.checkRuns(c.HTTP.MaxFailedRuns)},
+	}
+
+	var body strings.Builder
+	code := http.StatusOK
+	for _, check := range checks {
+		if check.err != nil {
+			code = http.StatusServiceUnavailable
+			fmt.Fprintf(&body, "%s: %s\n", check.name, strings.TrimSpace(check.err.Error()))
+			continue
+		}
+		fmt.Fprintf(&body, "%s: ok\n", check.name)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	io.WriteString(w, body.String())
+}
+
+func pingConsul(ctx context.Context, c *config) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	w, err := consul.NewConsul(c.ConsulConfig.URL, c.ConsulConfig.Token, c.ConsulConfig.LockKey, c.ConsulConfig.LockTimeout)
+	if err != nil {
+		return err
+	}
+	return w.Ping(ctx)
+}
+
+// checkConfig returns the error of the last config reload, as the config file is invalid until it is fixed
+func (s *snapshotter) checkConfig() error {
+	s.status.mu.Lock()
+	defer s.status.mu.Unlock()
+	if s.status.reloadErr != nil {
+		return fmt.Errorf("the config file is invalid, running with the last valid one: %v", s.status.reloadErr)
+	}
+	return nil
+}
+
+// checkRuns returns an error if maxFailed runs or more failed in a row
+func (s *snapshotter) checkRuns(maxFailed int) error {
+	s.status.mu.Lock()
+	defer s.status.mu.Unlock()
+	if s.status.failedRuns >= maxFailed {
+		return fmt.Errorf("the last %d runs failed, last error: %s", s.status.failedRuns, s.status.lastRun.Error)
+	}
+	return nil
+}
+
+// status is the body of the /status endpoint
+type status struct {
+	Cron    string                  `json:"cron"`
+	NextRun *time.Time              `json:"next-run"`
+	LastRun *runRecord              `json:"last-run"`
+	Outputs map[string]outputRecord `json:"outputs"`
+	Lock    lockStatus              `json:"lock"`
+}
+
+type lockStatus struct {
+	Key    string             `json:"key"`
+	Holder *consul.LockHolder `json:"holder"`
+	Error  string             `json:"error,omitempty"`
+}
+
+// serveStatus describes the schedule, the last run, the last result of each output, and the current lock holder
+func (s *snapshotter) serveStatus(w http.ResponseWriter, r *http.Request) {
+	c := s.currentConfig()
+	st := status{
+		Cron:    c.Cron,
+		NextRun: s.nextRun(),
+		Outputs: map[string]outputRecord{},
+		Lock:    lockStatus{Key: c.ConsulConfig.LockKey},
+	}
+
+	s.status.mu.Lock()
+	st.LastRun = s.status.lastRun
+	for name, o := range s.status.outputs {
+		st.Outputs[name] = o
+	}
+	s.status.mu.Unlock()
+
+	holder, err := lockHolder(r.Context(), c)
+	if err != nil {
+		st.Lock.Error = err.Error()
+	}
+	st.Lock.Holder = holder
+
+	writeJSON(w, http.StatusOK, st)
+}
+
+func lockHolder(ctx context.Context, c *config) (*consul.LockHolder, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	w, err := consul.NewConsul(c.ConsulConfig.URL, c.ConsulConfig.Token, c.ConsulConfig.LockKey, c.ConsulConfig.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return w.LockHolder(ctx)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+
+	"github.com/ruizink/consul-snapshotter/logger"
+)
+
+// snapshotter holds the config in use and the schedule built from it
+type snapshotter struct {
+	// guards all the fields below
+	mu     sync.Mutex
+	config *config
+	cron   *cron.Cron
+
+	// context of the scheduled backups
+	jobCtx context.Context
+	// set once the scheduler is stopped, so that no new backups start
+	stopped bool
+	// tracks in-flight backups, so that shutdown can wait for them
+	inFlight sync.WaitGroup
+
+	// serializes reloads, so that the last loaded config always wins
+	reloadMu sync.Mutex
+
+	// outcome of the runs and reloads, for the health and status endpoints
+	status runStatus
+	// the runs, for the control API
+	runs runRegistry
+	// the runs since the last digest was sent
+	digest runDigest
+}
+
+func newSnapshotter(c *config) *snapshotter {
+	return &snapshotter{config: c, digest: runDigest{since: time.Now().UTC()}}
+}
+
+// currentConfig returns the config in use. It must be treated as read-only.
+func (s *snapshotter) currentConfig() *config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+// run performs the backups until stopCtx is done, waiting for the in-flight one before returning.
+// Cancelling ctx aborts the in-flight backup.
+func (s *snapshotter) run(ctx, stopCtx context.Context) error {
+	c := s.currentConfig()
+
+	if c.Cron == "" {
+		logger.Info("Starting a single execution...")
+		return s.execute(ctx, newBackupRun(triggerSingle, nil, false))
+	}
+
+	logger.Info("Starting with cron expression: ", c.Cron)
+
+	s.mu.Lock()
+	s.jobCtx = ctx
+	err := s.schedule(c)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	<-stopCtx.Done()
+
+	s.mu.Lock()
+	s.cron.Stop()
+	s.stopped = true
+	s.mu.Unlock()
+
+	logger.Info("Scheduler stopped. Waiting for in-flight backup to finish...")
+	s.inFlight.Wait()
+	logger.Info("Terminated.")
+	return nil
+}
+
+// schedule replaces the running cron with a new one for the backups, digests and restore verifications of c.
+// Must be called with s.mu held.
+func (s *snapshotter) schedule(c *config) error {
+	sched := cron.New()
+	if err := sched.AddJob(c.Cron, &backupJob{s}); err != nil {
+		return fmt.Errorf("invalid cron expression %q: %v", c.Cron, err)
+	}
+	if sendsDigests(c) {
+		if err := sched.AddFunc(c.Notifications.DigestSchedule, s.sendDigest); err != nil {
+			return fmt.Errorf("invalid digest schedule %q: %v", c.Notifications.DigestSchedule, err)
+		}
+	}
+	if c.VerifyRestore.Schedule != "" {
+		if err := sched.AddFunc(c.VerifyRestore.Schedule, s.runVerifyRestore); err != nil {
+			return fmt.Errorf("invalid restore verification schedule %q: %v", c.VerifyRestore.Schedule, err)
+		}
+	}
+	sched.Start()
+
+	if s.cron != nil {
+		s.cron.Stop()
+	}
+	s.cron = sched
+	return nil
+}
+
+// backupJob runs the scheduled backups, and tells their entry apart from the other jobs of the scheduler
+type backupJob struct {
+	s *snapshotter
+}
+
+func (j *backupJob) Run() {
+	j.s.runScheduled()
+}
+
+func (s *snapshotter) runScheduled() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	ctx := s.jobCtx
+	s.inFlight.Add(1)
+	s.mu.Unlock()
+	defer s.inFlight.Done()
+
+	_ = s.execute(ctx, newBackupRun(triggerSchedule, nil, false))
+}
+
+func (s *snapshotter) runVerifyRestore() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	ctx := s.jobCtx
+	s.inFlight.Add(1)
+	s.mu.Unlock()
+	defer s.inFlight.Done()
+
+	_ = s.verifyRestore(ctx, triggerSchedule)
+}
+
+// errNotScheduling is returned by startRun when the snapshotter does not accept new runs
+var errNotScheduling = errors.New("not accepting new backups: the scheduler is not running (no cron set, or shutting down)")
+
+// startRun starts a backup run in the background, as a scheduled one would be, so that shutdown waits for it
+func (s *snapshotter) startRun(run *backupRun) error {
+	s.mu.Lock()
+	if s.jobCtx == nil || s.stopped {
+		s.mu.Unlock()
+		return errNotScheduling
+	}
+	ctx := s.jobCtx
+	s.inFlight.Add(1)
+	s.mu.Unlock()
+
+	ctx, cancel := s.track(ctx, run)
+	go func() {
+		defer s.inFlight.Done()
+		defer cancel()
+		run.finish(s.backup(ctx, run))
+	}()
+	return nil
+}
+
+// execute performs the backup run, waiting for it to finish
+func (s *snapshotter) execute(ctx context.Context, run *backupRun) error {
+	ctx, cancel := s.track(ctx, run)
+	defer cancel()
+	err := s.backup(ctx, run)
+	run.finish(err)
+	return err
+}
+
+// track registers run, which can be cancelled from then on through the returned context
+func (s *snapshotter) track(ctx context.Context, run *backupRun) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	run.cancel = cancel
+	s.runs.add(run)
+	return ctx, cancel
+}
+
+// reload loads and validates the config again, and only then swaps it with the one in use,
+// rescheduling the backups and re-applying the log level and format. On error, the current config is kept.
+// Backups already running keep the config they started with.
+func (s *snapshotter) reload() (err error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	defer func() { s.status.recordReload(err) }()
+
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cron != nil && !s.stopped && (c.Cron != s.config.Cron || digestsChanged(s.config, c) || c.VerifyRestore.Schedule != s.config.VerifyRestore.Schedule) {
+		if c.Cron == "" {
+			return fmt.Errorf("cron: cannot be removed while the scheduler is running")
+		}
+		if err := s.schedule(c); err != nil {
+			return err
+		}
+		logger.Info("Rescheduled with cron expression: ", c.Cron)
+	}
+
+	changes := diffConfig(s.config, c)
+
+	logger.SetLevel(c.LogLevel)
+	logger.SetFormat(c.LogFormat)
+	s.config = c
+
+	if len(changes) == 0 {
+		logger.Info("Config reloaded (no changes).")
+		return nil
+	}
+	logger.Info("Config reloaded with changes:")
+	for _, change := range changes {
+		logger.Info("  ", change)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// schedulerTimeout bounds the time the scheduler has to answer, before it is considered stuck
+const schedulerTimeout = 2 * time.Second
+
+// schedulerLag is how late a scheduled run can start, before the scheduler is considered stuck
+const schedulerLag = time.Minute
+
+// runStatus tracks the outcome of the backup runs, for the health and status endpoints
+type runStatus struct {
+	// guards all the fields below
+	mu sync.Mutex
+	// lastRun is the last run that finished, if any
+	lastRun *runRecord
+	// outputs holds the last result of each output, by name
+	outputs map[string]outputRecord
+	// failedRuns counts the runs that failed in a row
+	failedRuns int
+	// reloadErr is the error of the last config reload, if it failed
+	reloadErr error
+}
+
+type runRecord struct {
+	StartedAt  time.Time `json:"started-at"`
+	FinishedAt time.Time `json:"finished-at"`
+	Duration   string    `json:"duration"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type outputRecord struct {
+	Type       string    `json:"type"`
+	Required   bool      `json:"required"`
+	Status     string    `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	Deleted    int       `json:"deleted"`
+	FinishedAt time.Time `json:"finished-at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// recordRun records a run started at start, which ended with err after exporting the snapshot as in results.
+// It reports whether the run recovered from failed ones.
+func (st *runStatus) recordRun(start time.Time, results []outputResult, err error) (recovered bool) {
+	now := time.Now().UTC()
+	run := &runRecord{
+		StartedAt:  start.UTC(),
+		FinishedAt: now,
+		Duration:   now.Sub(start).Round(time.Millisecond).String(),
+		Result:     runResult(err),
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.lastRun = run
+	switch exitCode(err) {
+	case exitOK:
+		recovered = st.failedRuns > 0
+		st.failedRuns = 0
+	case exitLockBusy:
+		// another process took the backup
+	default:
+		st.failedRuns++
+	}
+
+	if st.outputs == nil {
+		st.outputs = map[string]outputRecord{}
+	}
+	for _, r := range results {
+		st.outputs[r.Name] = newOutputRecord(r, now)
+	}
+	return recovered
+}
+
+// newOutputRecord records the result r of an output, which finished at finishedAt
+func newOutputRecord(r outputResult, finishedAt time.Time) outputRecord {
+	o := outputRecord{
+		Type:       r.Type,
+		Required:   r.Required,
+		Status:     r.status(),
+		Bytes:      r.Bytes,
+		Deleted:    r.Deleted,
+		FinishedAt: finishedAt,
+	}
+	if err := r.err(); err != nil {
+		o.Error = err.Error()
+	}
+	return o
+}
+
+// recordReload records the outcome of a config reload
+func (st *runStatus) recordReload(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.reloadErr = err
+}
+
+// schedulerEntries returns the entries of the running scheduler, or nil for a single execution.
+// The scheduler answers from its own loop, so one that does not answer in time is stuck.
+func (s *snapshotter) schedulerEntries() ([]*cron.Entry, error) {
+	s.mu.Lock()
+	sched, stopped := s.cron, s.stopped
+	s.mu.Unlock()
+
+	if sched == nil {
+		return nil, nil
+	}
+	if stopped {
+		return nil, errors.New("scheduler stopped")
+	}
+
+	// the goroutine leaks if the scheduler never answers, which only happens once it is stuck
+	entries := make(chan []*cron.Entry, 1)
+	go func() { entries <- sched.Entries() }()
+	select {
+	case e := <-entries:
+		return e, nil
+	case <-time.After(schedulerTimeout):
+		return nil, fmt.Errorf("scheduler did not answer in %v", schedulerTimeout)
+	}
+}
+
+// checkScheduler returns an error if the scheduler is stopped, stuck, or late to start a run
+func (s *snapshotter) checkScheduler() error {
+	entries, err := s.schedulerEntries()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if late := time.Since(e.Next); late > schedulerLag {
+			return fmt.Errorf("scheduler is %v late to start the run due at %v", late.Round(time.Second), e.Next.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// nextRun returns the time of the next scheduled backup, or nil if there is none.
+// The digests and restore verifications scheduled along with the backups are left out.
+func (s *snapshotter) nextRun() *time.Time {
+	entries, err := s.schedulerEntries()
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		if _, ok := e.Job.(*backupJob); ok && !e.Next.IsZero() {
+			next := e.Next.UTC()
+			return &next
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chunkSize bounds the bytes read at once by a Reader, so that they are spread over time
+const chunkSize = 32 * 1024
+
+// Window sets the rate of a Schedule between two times of the day
+type Window struct {
+	// From and To are offsets from midnight, in local time. A window whose To is before its From spans midnight.
+	From, To time.Duration
+	// Rate is the limit in bytes per second (0 - no limit)
+	Rate int64
+}
+
+// contains reports whether the offset from midnight d is within the window
+func (w Window) contains(d time.Duration) bool {
+	if w.From <= w.To {
+		return d >= w.From && d < w.To
+	}
+	return d >= w.From || d < w.To
+}
+
+// Schedule is a rate that changes with the time of the day
+type Schedule struct {
+	// Rate is the limit in bytes per second outside of the windows (0 - no limit)
+	Rate int64
+	// Windows override Rate, the first one the time of the day is in winning
+	Windows []Window
+}
+
+// RateAt returns the limit in bytes per second at t (0 - no limit)
+func (s Schedule) RateAt(t time.Time) int64 {
+	t = t.Local()
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, w := range s.Windows {
+		if w.contains(d) {
+			return w.Rate
+		}
+	}
+	return s.Rate
+}
+
+// Limiter spreads the bytes it is told about over time, so that they do not exceed the rate of its schedule.
+// It is safe for concurrent use, the bytes of all its users sharing the rate. A nil Limiter does not limit.
+type Limiter struct {
+	schedule Schedule
+
+	mu sync.Mutex
+	// the time the bytes already waited for are spread until
+	next time.Time
+}
+
+// NewLimiter returns a Limiter following s, or nil if s never limits
+func NewLimiter(s Schedule) *Limiter {
+	limited := s.Rate > 0
+	for _, w := range s.Windows {
+		limited = limited || w.Rate > 0
+	}
+	if !limited {
+		return nil
+	}
+	return &Limiter{schedule: s}
+}
+
+// Rate returns the current limit in bytes per second (0 - no limit)
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.schedule.RateAt(time.Now())
+}
+
+// reserve spreads n more bytes over time, and returns how long to wait for them to fit in the rate
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	rate := l.schedule.RateAt(now)
+	if rate <= 0 {
+		return 0
+	}
+	// time not used by anyone is not saved up, so that the rate is never exceeded
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	return l.next.Sub(now)
+}
+
+// Reader is an io.Reader that delivers what it reads no faster than its limiters allow, failing once its context is done
+type Reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+// NewReader returns a Reader reading from r, limited by every one of limiters
+func NewReader(ctx context.Context, r io.Reader, limiters ...*Limiter) *Reader {
+	return &Reader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (tr *Reader) Read(p []byte) (int, error) {
+	if err := tr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := tr.r.Read(p)
+
+	// the bytes are delivered once they fit in the rate of every limiter
+	var wait time.Duration
+	for _, l := range tr.limiters {
+		wait = max(wait, l.reserve(n))
+	}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-tr.ctx.Done():
+			return 0, tr.ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return n, err
+}
+
+var rateRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-zA-Z]*)(?:/s)?$`)
+
+var rateUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// ParseRate parses a rate in bytes per second, as a number of bytes or a size with a unit,
+// decimal (kB, MB, GB) or binary (KiB, MiB, GiB), e.g. "512KiB" or "10MB/s"
+func ParseRate(s string) (int64, error) {
+	m := rateRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid rate %q, expected bytes per second (e.g. 10MiB)", s)
+	}
+	unit, ok := rateUnits[strings.ToLower(m[2])]
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q: unknown unit %q", s, m[2])
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q: %v", s, err)
+	}
+	return int64(n * unit), nil
+}
+
+// FormatRate formats a rate in bytes per second for humans (e.g. "1.5 MiB/s")
+func FormatRate(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B/s", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB/s", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// ParseTimeOfDay parses a time of the day as "15:04", into its offset from midnight
+func ParseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of the day %q, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,151 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleRateAt(t *testing.T) {
+	schedule := Schedule{
+		Rate: 100,
+		Windows: []Window{
+			// office hours
+			{From: 8 * time.Hour, To: 20 * time.Hour, Rate: 10},
+			// overlaps the first window, which wins
+			{From: 19 * time.Hour, To: 21 * time.Hour, Rate: 20},
+			// spans midnight
+			{From: 23 * time.Hour, To: 2*time.Hour + 30*time.Minute, Rate: 0},
+		},
+	}
+	tests := []struct {
+		at   string
+		want int64
+	}{
+		{"07:59:59", 100},
+		{"08:00:00", 10},
+		{"12:00:00", 10},
+		{"19:30:00", 10},
+		{"20:00:00", 20},
+		{"20:59:59", 20},
+		{"21:00:00", 100},
+		{"22:59:59", 100},
+		{"23:00:00", 0},
+		{"00:00:00", 0},
+		{"02:29:59", 0},
+		{"02:30:00", 100},
+	}
+	for _, tt := range tests {
+		clock, err := time.Parse("15:04:05", tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := time.Date(2026, 10, 18, clock.Hour(), clock.Minute(), clock.Second(), 0, time.Local)
+		if got := schedule.RateAt(at); got != tt.want {
+			t.Errorf("RateAt(%s) = %d, want %d", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestNewLimiter(t *testing.T) {
+	if l := NewLimiter(Schedule{}); l != nil {
+		t.Error("NewLimiter() of a schedule without limits is not nil")
+	}
+	if l := NewLimiter(Schedule{Windows: []Window{{From: time.Hour, To: 2 * time.Hour}}}); l != nil {
+		t.Error("NewLimiter() of a schedule whose windows do not limit is not nil")
+	}
+	if l := NewLimiter(Schedule{Windows: []Window{{From: time.Hour, To: 2 * time.Hour, Rate: 10}}}); l == nil {
+		t.Error("NewLimiter() of a schedule with a limited window is nil")
+	}
+
+	var l *Limiter
+	if got := l.Rate(); got != 0 {
+		t.Errorf("Rate() of a nil Limiter = %d, want 0", got)
+	}
+	if got := l.reserve(1 << 20); got != 0 {
+		t.Errorf("reserve() of a nil Limiter = %v, want 0", got)
+	}
+}
+
+func TestLimiterReserve(t *testing.T) {
+	l := NewLimiter(Schedule{Rate: 1000})
+	// the bytes of every call are spread after the ones before
+	for i, want := range []time.Duration{500 * time.Millisecond, time.Second, 1500 * time.Millisecond} {
+		got := l.reserve(500)
+		if got > want || got < want-50*time.Millisecond {
+			t.Errorf("reserve() #%d = %v, want about %v", i+1, got, want)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3000)
+
+	start := time.Now()
+	got, err := io.ReadAll(NewReader(context.Background(), bytes.NewReader(data), NewLimiter(Schedule{Rate: 10000}), nil))
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, want %d", len(got), len(data))
+	}
+	if elapsed < 250*time.Millisecond {
+		t.Errorf("read 3000 bytes at 10000 B/s in %v, want about 300ms", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = io.ReadAll(NewReader(ctx, bytes.NewReader(data), NewLimiter(Schedule{Rate: 100})))
+	if err != context.DeadlineExceeded {
+		t.Errorf("ReadAll() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ReadAll() gave up after %v, want it to give up with its context", elapsed)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr string
+	}{
+		{in: "1024", want: 1024},
+		{in: "512B", want: 512},
+		{in: "10MB/s", want: 10e6},
+		{in: "1.5 KiB", want: 1536},
+		{in: "2gib", want: 2 << 30},
+		{in: " 50MiB ", want: 50 << 20},
+		{in: "10 Mbps", wantErr: `unknown unit "Mbps"`},
+		{in: "-5MiB", wantErr: "expected bytes per second"},
+		{in: "fast", wantErr: "expected bytes per second"},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseRate(%q) error = %v, want one containing %q", tt.in, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseTimeOfDay(t *testing.T) {
+	if got, err := ParseTimeOfDay("08:30"); err != nil || got != 8*time.Hour+30*time.Minute {
+		t.Errorf("ParseTimeOfDay(08:30) = %v, %v, want 8h30m", got, err)
+	}
+	for _, in := range []string{"8am", "24:00", "08:30:00", ""} {
+		if _, err := ParseTimeOfDay(in); err == nil {
+			t.Errorf("ParseTimeOfDay(%q) succeeded", in)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of the spans
+const instrumentationName = "github.com/ruizink/consul-snapshotter"
+
+// span attributes shared by the packages
+const (
+	AttrCluster = attribute.Key("consul.datacenter")
+	AttrIndex   = attribute.Key("consul.snapshot.index")
+	AttrBytes   = attribute.Key("snapshot.bytes")
+	AttrOutput  = attribute.Key("output.name")
+	AttrType    = attribute.Key("output.type")
+	AttrDeleted = attribute.Key("retention.deleted")
+	// AttrSnapshot is the name of a snapshot file or blob
+	AttrSnapshot = attribute.Key("snapshot.name")
+)
+
+// Config sets where and how the traces are exported
+type Config struct {
+	// Endpoint is the URL of the OTLP/HTTP collector (e.g. http://localhost:4318), or empty to
+	// follow the OTEL_EXPORTER_OTLP_ENDPOINT env vars
+	Endpoint    string
+	ServiceName string
+	Version     string
+	// SampleRatio is the share of the runs to trace, from 0 to 1
+	SampleRatio float64
+}
+
+// Setup exports the spans to the OTLP collector of cfg, until the returned function is called to flush and stop.
+// Until Setup is called, spans are not recorded.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	var opts []otlptracehttp.Option
+	if cfg.Endpoint != "" {
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %v", cfg.Endpoint, err)
+		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		if strings.Trim(u.Path, "/") == "" {
+			opts = append(opts, otlptracehttp.WithURLPath("/v1/traces"))
+		}
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating the trace exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+		semconv.ServiceVersion(cfg.Version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("error describing the service: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start starts a span, a child of the one in ctx if any
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it as failed if err is not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace of ctx, or "" if it is not recorded
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsSampled() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ruizink/consul-snapshotter/consul"
+)
+
+// backupState is recorded in Consul KV, at consul.state-key, when skip-unchanged or sanity-checks.max-shrink is enabled
+type backupState struct {
+	// Heartbeat is the time of the last run, whether it uploaded the snapshot or not
+	Heartbeat time.Time `json:"heartbeat"`
+	// Outputs holds the last snapshot uploaded to each output
+	Outputs map[string]outputState `json:"outputs"`
+	// LastSnapshot is the last snapshot that passed the sanity checks, if any
+	LastSnapshot *snapshotState `json:"last-snapshot,omitempty"`
+}
+
+type outputState struct {
+	LastIndex   uint64    `json:"last-index"`
+	Fingerprint string    `json:"fingerprint"`
+	UploadedAt  time.Time `json:"uploaded-at"`
+}
+
+// readBackupState reads the state at key, or returns an empty one if there is none yet.
+// It returns nil if the state could not be read, so that it is neither used nor overwritten.
+func readBackupState(ctx context.Context, w *consul.Worker, key string) (*backupState, error) {
+	st := &backupState{Outputs: map[string]outputState{}}
+
+	value, err := w.GetKey(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", key, err)
+	}
+	if value == nil {
+		return st, nil
+	}
+	if err := json.Unmarshal(value, st); err != nil {
+		return nil, fmt.Errorf("could not decode %s: %v", key, err)
+	}
+	if st.Outputs == nil {
+		st.Outputs = map[string]outputState{}
+	}
+	return st, nil
+}
+
+func (st *backupState) write(ctx context.Context, w *consul.Worker, key string) error {
+	value, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := w.PutKey(ctx, key, value); err != nil {
+		return fmt.Errorf("could not write %s: %v", key, err)
+	}
+	return nil
+}
+
+// unchanged returns the last snapshot uploaded to the output named name, and whether it has the given fingerprint
+// and was uploaded less than maxInterval before now (0 - no maximum), so that uploading another one can be skipped
+func (st *backupState) unchanged(name, fingerprint string, maxInterval time.Duration, now time.Time) (outputState, bool) {
+	last, ok := st.Outputs[name]
+	if !ok || fingerprint == "" || last.Fingerprint != fingerprint {
+		return last, false
+	}
+	if maxInterval > 0 && now.Sub(last.UploadedAt) >= maxInterval {
+		return last, false
+	}
+	return last, true
+}
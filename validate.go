@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/robfig/cron"
+
+	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/naming"
+	"github.com/ruizink/consul-snapshotter/notify"
+	"github.com/ruizink/consul-snapshotter/outputs"
+)
+
+// bounds of the session TTL accepted by Consul
+const (
+	minLockTimeout = 10 * time.Second
+	maxLockTimeout = 24 * time.Hour
+)
+
+// validate checks the config for every setting, or combination of settings, that could only fail once in use.
+// It returns a *multierror.Error listing all the problems found, or nil if there are none.
+func (c *config) validate() error {
+	var errs error
+	problem := func(format string, a ...interface{}) {
+		errs = multierror.Append(errs, fmt.Errorf(format, a...))
+	}
+
+	if c.Cron != "" {
+		if _, err := cron.Parse(c.Cron); err != nil {
+			problem("cron: invalid expression %q: %v", c.Cron, err)
+		}
+	}
+
+	if tmpl, err := naming.New(c.FilenameTemplate); err != nil {
+		problem("filename-template: %v", err)
+	} else {
+		if !tmpl.Uses("Time") && !tmpl.Uses("LastIndex") && !tmpl.Uses("RunID") {
+			problem("filename-template: must use .Time, .LastIndex or .RunID, so that the snapshots do not overwrite each other")
+		}
+		if _, err := tmpl.Render(sampleNamingData(c)); err != nil {
+			problem("filename-template: %v", err)
+		}
+	}
+
+	if err := logger.CheckLevel(c.LogLevel); err != nil {
+		problem("log-level: %v", err)
+	}
+	if err := logger.CheckFormat(c.LogFormat); err != nil {
+		problem("log-format: %v", err)
+	}
+
+	if c.ShutdownGracePeriod < 0 {
+		problem("shutdown-grace-period: must not be negative")
+	}
+	if c.WatchConfig && c.WatchDebounce <= 0 {
+		problem("watch-config-debounce: must be positive")
+	}
+
+	if c.HTTP.Address != "" {
+		if _, port, err := net.SplitHostPort(c.HTTP.Address); err != nil || port == "" {
+			problem("http.address: invalid address %q, must be host:port (e.g. \":9100\")", c.HTTP.Address)
+		}
+	}
+	if c.HTTP.APIToken != "" && c.HTTP.Address == "" {
+		problem("http.api-token: the control API requires http.address")
+	}
+	if c.HTTP.MaxFailedRuns < 1 {
+		problem("http.max-failed-runs: must be at least 1")
+	}
+
+	if c.Tracing.Endpoint != "" && !validHTTPURL(c.Tracing.Endpoint) {
+		problem("tracing.endpoint: invalid URL %q, must be an http or https URL (e.g. \"http://localhost:4318\")", c.Tracing.Endpoint)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problem("tracing.sample-ratio: must be between 0 and 1")
+	}
+	if c.Tracing.Enabled && c.Tracing.ServiceName == "" {
+		problem("tracing.service-name: must be set")
+	}
+
+	// Consul
+	if !validConsulAddress(c.ConsulConfig.URL) {
+		problem("consul.url: invalid address %q", c.ConsulConfig.URL)
+	}
+	if c.ConsulConfig.LockKey == "" {
+		problem("consul.lock-key: must not be empty")
+	}
+	if c.ConsulConfig.LockTimeout < minLockTimeout || c.ConsulConfig.LockTimeout > maxLockTimeout {
+		problem("consul.lock-timeout: must be between %v and %v", minLockTimeout, maxLockTimeout)
+	}
+
+	// Timeouts
+	if c.Timeouts.Snapshot < 0 {
+		problem("timeouts.snapshot: must not be negative")
+	}
+	if c.Timeouts.Upload < 0 {
+		problem("timeouts.upload: must not be negative")
+	}
+	if c.Timeouts.Retention < 0 {
+		problem("timeouts.retention: must not be negative")
+	}
+
+	c.Retry.validate("retry", problem)
+	c.Bandwidth.validate("bandwidth", problem)
+
+	// Outputs
+	if len(c.Outputs) == 0 {
+		problem("outputs: at least one output is required")
+	}
+	if c.keepsState() {
+		if c.ConsulConfig.StateKey == "" {
+			problem("consul.state-key: must not be empty with skip-unchanged or sanity-checks.max-shrink")
+		}
+		if c.ConsulConfig.StateKey == c.ConsulConfig.LockKey {
+			problem("consul.state-key: must not be the same key as consul.lock-key")
+		}
+	}
+	if c.SkipUnchanged.Enabled && c.SkipUnchanged.MaxInterval < 0 {
+		problem("skip-unchanged.max-interval: must not be negative")
+	}
+	if c.OutputConcurrency == 0 {
+		problem("output-concurrency: must be at least 1")
+	}
+	seen := map[string]bool{}
+	for i, oc := range c.Outputs {
+		if oc.Name == "" {
+			problem("outputs.%d: name is required", i)
+			continue
+		}
+		prefix := fmt.Sprintf("outputs[%s]", oc.Name)
+
+		if !outputNameRegexp.MatchString(oc.Name) {
+			problem("%s: name may only contain letters, digits, '_', '.' and '-'", prefix)
+		}
+		if seen[oc.Name] {
+			problem("%s: name is used by more than one output", prefix)
+		}
+		seen[oc.Name] = true
+
+		for _, key := range oc.unknownKeys {
+			problem("%s: unknown setting %q for output type %q", prefix, key, oc.Type)
+		}
+		for _, err := range oc.invalidSettings {
+			problem("%s.%v", prefix, err)
+		}
+		// the top-level retry policy was validated already
+		if oc.Retry != c.Retry {
+			oc.Retry.validate(prefix+".retry", problem)
+		}
+		oc.Bandwidth.validate(prefix+".bandwidth", problem)
+
+		// an output that prunes its snapshots must get a new one before they all expire
+		if retention := oc.retentionPeriod(); c.SkipUnchanged.Enabled && retention > 0 &&
+			(c.SkipUnchanged.MaxInterval == 0 || c.SkipUnchanged.MaxInterval >= retention) {
+			problem("%s: skip-unchanged.max-interval must be shorter than the retention-period (%v), or all the snapshots could expire", prefix, retention)
+		}
+
+		switch oc.Type {
+		case outputTypeLocal:
+			oc.Local.validate(prefix, problem)
+		case outputTypeAzureBlob:
+			oc.AzureBlob.validate(prefix, problem)
+		case "":
+			problem("%s: type is required (valid types: %s, %s)", prefix, outputTypeLocal, outputTypeAzureBlob)
+		default:
+			problem("%s: unknown type %q (valid types: %s, %s)", prefix, oc.Type, outputTypeLocal, outputTypeAzureBlob)
+		}
+	}
+
+	// Sanity checks
+	if c.SanityChecks.MinKVEntries < 0 {
+		problem("sanity-checks.min-kv-entries: must not be negative")
+	}
+	if c.SanityChecks.MinNodes < 0 {
+		problem("sanity-checks.min-nodes: must not be negative")
+	}
+	if c.SanityChecks.MinServices < 0 {
+		problem("sanity-checks.min-services: must not be negative")
+	}
+	for i, prefix := range c.SanityChecks.RequiredKVPrefixes {
+		if prefix == "" {
+			problem("sanity-checks.required-kv-prefixes.%d: must not be empty", i)
+		}
+	}
+	if c.SanityChecks.MaxShrink < 0 || c.SanityChecks.MaxShrink >= 1 {
+		problem("sanity-checks.max-shrink: must be at least 0 and less than 1")
+	}
+
+	// Restore verifications
+	vr := c.VerifyRestore
+	if vr.Schedule != "" {
+		if c.Cron == "" {
+			problem("verify-restore.schedule: restore verifications are only scheduled by a scheduled execution (with cron)")
+		}
+		if _, err := cron.Parse(vr.Schedule); err != nil {
+			problem("verify-restore.schedule: invalid expression %q: %v", vr.Schedule, err)
+		}
+	}
+	if vr.Output != "" && !slices.ContainsFunc(c.Outputs, func(oc outputConfig) bool { return oc.Name == vr.Output }) {
+		problem("verify-restore.output: unknown output %q", vr.Output)
+	}
+	switch {
+	case vr.URL == "" && vr.ConsulBinary == "":
+		problem("verify-restore.consul-binary: must be set, unless verify-restore.url is")
+	case vr.URL == "" && vr.Token != "":
+		problem("verify-restore.token: is only used with verify-restore.url")
+	case vr.URL != "" && !validHTTPURL(vr.URL):
+		problem("verify-restore.url: must be an http or https URL")
+	case vr.URL != "" && sameURL(vr.URL, c.ConsulConfig.URL):
+		problem("verify-restore.url: must not be consul.url, as the restore replaces the state of the cluster")
+	}
+	if vr.Timeout <= 0 {
+		problem("verify-restore.timeout: must be positive")
+	}
+
+	// Hooks
+	if c.Hooks.Timeout < 0 {
+		problem("hooks.timeout: must not be negative")
+	}
+	for _, event := range hookEvents {
+		for i, h := range *c.Hooks.hooks(event) {
+			h.validate(fmt.Sprintf("hooks.%s.%d", event, i), event, problem)
+		}
+	}
+
+	// Notifications
+	if c.Notifications.Timeout <= 0 {
+		problem("notifications.timeout: must be positive")
+	}
+	digests := false
+	seen = map[string]bool{}
+	for i, nc := range c.Notifiers {
+		if nc.Name == "" {
+			problem("notifiers.%d: name is required", i)
+			continue
+		}
+		prefix := fmt.Sprintf("notifiers[%s]", nc.Name)
+		if seen[nc.Name] {
+			problem("%s: name is used by more than one notifier", prefix)
+		}
+		seen[nc.Name] = true
+
+		nc.validate(prefix, problem)
+		digests = digests || nc.wants(notify.EventDigest)
+	}
+	if digests {
+		if c.Cron == "" {
+			problem("notifiers: digests are only sent by a scheduled execution (with cron)")
+		}
+		if _, err := cron.Parse(c.Notifications.DigestSchedule); err != nil {
+			problem("notifications.digest-schedule: invalid expression %q: %v", c.Notifications.DigestSchedule, err)
+		}
+	}
+
+	return errs
+}
+
+func (rc *retryConfig) validate(prefix string, problem func(format string, a ...interface{})) {
+	if rc.MaxAttempts < 1 {
+		problem("%s.max-attempts: must be at least 1", prefix)
+	}
+	if rc.InitialBackoff < 0 {
+		problem("%s.initial-backoff: must not be negative", prefix)
+	}
+	if rc.MaxBackoff < rc.InitialBackoff {
+		problem("%s.max-backoff: must not be less than initial-backoff", prefix)
+	}
+	if rc.Jitter < 0 || rc.Jitter > 1 {
+		problem("%s.jitter: must be between 0 and 1", prefix)
+	}
+}
+
+func (lc *localOutputConfig) validate(prefix string, problem func(format string, a ...interface{})) {
+	if lc.DestinationPath == "" {
+		problem("%s.destination-path: must not be empty", prefix)
+	}
+	if lc.RetentionPeriod < 0 {
+		problem("%s.retention-period: must not be negative", prefix)
+	}
+	validateLayout(lc.Layout, prefix, problem)
+}
+
+func (ac *azureOutputConfig) validate(prefix string, problem func(format string, a ...interface{})) {
+	if ac.ContainerName == "" {
+		problem("%s.container-name: must not be empty", prefix)
+	}
+	if ac.StorageAccount == "" {
+		problem("%s.storage-account: must not be empty", prefix)
+	}
+	switch {
+	case ac.StorageAccessKey == "" && ac.StorageSASToken == "":
+		problem("%s: one of storage-access-key or storage-sas-token is required", prefix)
+	case ac.StorageAccessKey != "" && ac.StorageSASToken != "":
+		problem("%s: storage-access-key and storage-sas-token are mutually exclusive", prefix)
+	}
+	if ac.BlockSize <= 0 {
+		problem("%s.block-size: must be positive", prefix)
+	}
+	if ac.Parallelism == 0 {
+		problem("%s.parallelism: must be positive", prefix)
+	}
+	if ac.RetentionPeriod < 0 {
+		problem("%s.retention-period: must not be negative", prefix)
+	}
+	if ac.Emulated {
+		if u, err := url.Parse(ac.EmulatorUrl); err != nil || u.Host == "" {
+			problem("%s.emulator-url: invalid URL %q", prefix, ac.EmulatorUrl)
+		}
+	}
+	validateLayout(ac.Layout, prefix, problem)
+}
+
+func validateLayout(layout, prefix string, problem func(format string, a ...interface{})) {
+	if layout != outputs.LayoutFlat && layout != outputs.LayoutDate {
+		problem("%s.layout: unknown layout %q (valid layouts: %s, %s)", prefix, layout, outputs.LayoutFlat, outputs.LayoutDate)
+	}
+}
+
+// sampleNamingData returns typical values of the snapshot file name fields, to check the filename template with
+func sampleNamingData(c *config) naming.Data {
+	return naming.Data{
+		Datacenter: "dc1",
+		NodeName:   "node1",
+		Hostname:   "host1",
+		RunID:      "0123456789abcdef",
+		Output:     "local",
+		Prefix:     c.FilenamePrefix,
+		Extension:  c.FileExtension,
+		LastIndex:  1,
+		Time:       time.Now().UTC(),
+	}
+}
+
+// validConsulAddress accepts the same addresses as the Consul client: a URL, a unix socket or a bare host:port
+func validConsulAddress(addr string) bool {
+	if !strings.Contains(addr, "://") {
+		return addr != ""
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "unix" {
+		return u.Path != ""
+	}
+	return u.Host != ""
+}
+
+// configProblems splits an error returned by validate into the problems found
+func configProblems(err error) []error {
+	var merr *multierror.Error
+	if errors.As(err, &merr) {
+		return merr.Errors
+	}
+	return []error{err}
+}
+
+// logConfigError logs msg followed by each problem found in the config
+func logConfigError(msg string, err error) {
+	logger.Error(msg)
+	for _, problem := range configProblems(err) {
+		logger.Error("  - ", problem)
+	}
+}
+
+// validHTTPURL accepts absolute http and https URLs
+func validHTTPURL(addr string) bool {
+	u, err := url.Parse(addr)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// sameURL reports whether the URLs a and b, which may lack their scheme, point to the same host and port
+func sameURL(a, b string) bool {
+	host := func(addr string) string {
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		if u, err := url.Parse(addr); err == nil {
+			return strings.ToLower(u.Host)
+		}
+		return addr
+	}
+	return host(a) == host(b)
+}
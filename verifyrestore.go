@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/ruizink/consul-snapshotter/consul"
+	"github.com/ruizink/consul-snapshotter/logger"
+	"github.com/ruizink/consul-snapshotter/metrics"
+	"github.com/ruizink/consul-snapshotter/naming"
+	"github.com/ruizink/consul-snapshotter/notify"
+	"github.com/ruizink/consul-snapshotter/tracing"
+)
+
+// verifyRestore restores the latest snapshot of the output set by verify-restore.output into a scratch Consul,
+// and runs the sanity checks against the restored cluster. The result is logged, recorded in the metrics and notified.
+func (s *snapshotter) verifyRestore(ctx context.Context, trigger string) (err error) {
+	c := s.currentConfig()
+	vr := c.VerifyRestore
+	start := time.Now()
+	id := newRunID()
+	oc := c.Outputs[0]
+	for _, o := range c.Outputs {
+		if o.Name == vr.Output {
+			oc = o
+		}
+	}
+
+	ctx, span := tracing.Start(ctx, "verify-restore", attribute.String("run.id", id), attribute.String("run.trigger", trigger), tracing.AttrOutput.String(oc.Name))
+	log := logger.With("run_id", id, "trigger", trigger, "output", oc.Name)
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		log = log.With("trace_id", traceID)
+	}
+	ctx = logger.NewContext(ctx, log)
+
+	ctx, cancel := withTimeout(ctx, vr.Timeout)
+	defer cancel()
+
+	// the cluster the snapshots are taken of, which labels the metrics and notifications
+	cluster := ""
+	var (
+		latest   snapshotInfo
+		contents *consul.Contents
+	)
+	defer func() {
+		span.SetAttributes(tracing.AttrCluster.String(cluster), tracing.AttrSnapshot.String(latest.Name))
+		tracing.End(span, err)
+		result := runResult(err)
+		metrics.RestoreVerifications.WithLabelValues(cluster, oc.Name, result).Inc()
+		if err == nil {
+			metrics.LastRestoreVerified.WithLabelValues(cluster, oc.Name).SetToCurrentTime()
+			log.Info(fmt.Sprintf("===> Restore verified: %s (took %v)", latest.Name, time.Since(start).Round(time.Millisecond)))
+		} else {
+			log.Error("===> Restore verification failed: ", err)
+		}
+		// verifications cancelled on shutdown are not notified
+		if !errors.Is(ctx.Err(), context.Canceled) {
+			s.notifyRestore(ctx, c, id, trigger, cluster, start, oc.Name, latest, contents, err)
+		}
+	}()
+
+	log.Info("===> Verifying the latest snapshot can be restored...")
+	source, err := consul.NewConsul(c.ConsulConfig.URL, c.ConsulConfig.Token, "", 0)
+	if err == nil {
+		agentCtx, cancelAgent := withTimeout(ctx, c.Timeouts.Snapshot)
+		var agent *consul.AgentInfo
+		if agent, err = source.GetAgentInfo(agentCtx); err == nil {
+			cluster = agent.Datacenter
+		}
+		cancelAgent()
+	}
+	if err != nil {
+		log.Warn("Could not read the agent info: ", err)
+	}
+	log = log.With("cluster", cluster)
+	ctx = logger.NewContext(ctx, log)
+
+	// Find the latest snapshot of the output
+	tmpl, err := naming.New(c.FilenameTemplate)
+	if err != nil {
+		return &runError{exitError, fmt.Errorf("invalid filename template: %v", err)}
+	}
+	if cluster == "" && tmpl.Uses("Datacenter") {
+		return &runError{exitRestoreFailed, errors.New("could not read the datacenter, which the snapshot file names hold")}
+	}
+	snapshots, err := listSnapshots(ctx, c, tmpl, oc, cluster)
+	if err != nil {
+		return &runError{exitRestoreFailed, fmt.Errorf("could not list the snapshots: %v", err)}
+	}
+	if len(snapshots) == 0 {
+		return &runError{exitRestoreFailed, fmt.Errorf("output %s holds no snapshot", oc.Name)}
+	}
+	latest = latestSnapshot(snapshots)
+	log.Info(fmt.Sprintf("Latest snapshot: %s (%d bytes)", latest.Name, latest.Size))
+
+	// Start the scratch Consul to restore into, unless one is provided
+	url := vr.URL
+	var ignoreNodes []string
+	if url == "" {
+		log.Info("Starting a Consul dev agent with ", vr.ConsulBinary)
+		agent, err := consul.StartDevAgent(ctx, vr.ConsulBinary)
+		if err != nil {
+			return &runError{exitRestoreFailed, fmt.Errorf("could not start a Consul dev agent: %v", err)}
+		}
+		defer func() {
+			if err := agent.Stop(); err != nil {
+				log.Warn("Could not stop the Consul dev agent: ", err)
+			}
+		}()
+		log.Debug("Started a Consul dev agent at ", agent.URL)
+		url, ignoreNodes = agent.URL, []string{consul.DevNodeName}
+	}
+	scratch, err := consul.NewConsul(url, vr.Token, "", 0)
+	if err != nil {
+		return &runError{exitRestoreFailed, err}
+	}
+
+	// Restore the snapshot, streamed from the output
+	in, err := newOutput(oc, "", snapshotMatcher(c, tmpl, oc, cluster)).Open(ctx, latest.Name)
+	if err != nil {
+		return &runError{exitRestoreFailed, fmt.Errorf("could not read %s: %v", latest.Name, err)}
+	}
+	defer in.Close()
+	if err := scratch.RestoreSnapshot(ctx, in); err != nil {
+		return &runError{exitRestoreFailed, err}
+	}
+	log.Info("Restored the snapshot into ", url)
+
+	// Check the restored cluster holds what it should
+	sc := c.SanityChecks
+	contents, err = scratch.Contents(ctx, sc.RequiredKVPrefixes, []string{c.ConsulConfig.LockKey, c.ConsulConfig.StateKey}, ignoreNodes...)
+	if err != nil {
+		return &runError{exitRestoreFailed, fmt.Errorf("could not read the restored cluster: %v", err)}
+	}
+	log.Info(fmt.Sprintf("Restored cluster contents: %d KV entries, %d nodes, %d services", contents.KVEntries, contents.Nodes, contents.Services))
+
+	var errs error
+	for _, p := range sc.contentsProblems(contents, "the restored cluster") {
+		errs = multierror.Append(errs, p.err)
+	}
+	if errs != nil {
+		return &runError{exitRestoreFailed, errs}
+	}
+	return nil
+}
+
+// latestSnapshot returns the snapshot taken last, after the time in its name, or when it was saved
+func latestSnapshot(snapshots []snapshotInfo) snapshotInfo {
+	taken := func(s snapshotInfo) time.Time {
+		if s.Time != nil {
+			return *s.Time
+		}
+		return s.ModTime
+	}
+	latest := snapshots[0]
+	for _, s := range snapshots[1:] {
+		if taken(s).After(taken(latest)) {
+			latest = s
+		}
+	}
+	return latest
+}
+
+// notifyRestore sends the event of a restore verification, started at start and ended with err, to the notifiers
+// that want it. snap is the snapshot of the output it restored, and contents what the restored cluster held, if known.
+func (s *snapshotter) notifyRestore(ctx context.Context, c *config, id, trigger, cluster string, start time.Time, output string, snap snapshotInfo, contents *consul.Contents, err error) {
+	if len(c.Notifiers) == 0 {
+		return
+	}
+
+	e := notify.Event{
+		Kind:      notify.EventRestoreVerified,
+		Cluster:   clusterName(c, cluster),
+		RunID:     id,
+		Trigger:   trigger,
+		Result:    runResult(err),
+		StartedAt: start.UTC(),
+		Duration:  time.Since(start).Round(time.Millisecond).String(),
+		Index:     snap.LastIndex,
+		Size:      snap.Size,
+		Restore:   &notify.Restore{Output: output, Snapshot: snap.Name},
+	}
+	if contents != nil {
+		e.Restore.KVEntries, e.Restore.Nodes, e.Restore.Services = contents.KVEntries, contents.Nodes, contents.Services
+	}
+	e.Summary = fmt.Sprintf("Consul snapshot restore verified on %s (%s, from %s)", e.Cluster, snap.Name, output)
+	if err != nil {
+		e.Kind = notify.EventRestoreFailed
+		// multierror lists end with blank lines
+		e.Error = strings.TrimSpace(err.Error())
+		e.Summary = fmt.Sprintf("Consul snapshot restore verification failed on %s (output %s)", e.Cluster, output)
+	}
+
+	s.send(ctx, c, func(nc notifierConfig) (notify.Event, bool) {
+		return e, nc.wants(e.Kind)
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/ruizink/consul-snapshotter/logger"
+)
+
+// watchConfig reloads the config every time the config file in dir changes, until ctx is done.
+// The directory is watched rather than the file, so that files replaced by editors or by
+// Kubernetes ConfigMap updates (an atomic swap of the "..data" symlink) are picked up too.
+// Bursts of events are debounced into a single reload.
+func (s *snapshotter) watchConfig(ctx context.Context, dir string, debounce time.Duration) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	logger.Info("Watching for config changes in: ", dir)
+
+	// armed on every event, so that it only fires once the file has settled
+	reload := time.AfterFunc(debounce, func() {
+		logger.Info("Config file changed. Triggering a config reload.")
+		if err := s.reload(); err != nil {
+			logConfigError("Could not reload config, keeping the current one:", err)
+		}
+	})
+	reload.Stop()
+
+	go func() {
+		defer watcher.Close()
+		defer reload.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isConfigFileEvent(event) {
+					continue
+				}
+				logger.Debug("Config watcher event: ", event)
+				reload.Reset(debounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Config watcher error: ", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// isConfigFileEvent reports whether event may have changed the config file
+func isConfigFileEvent(event fsnotify.Event) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	name := filepath.Base(event.Name)
+	return name == "..data" || strings.HasPrefix(name, "config.")
+}